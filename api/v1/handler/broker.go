@@ -0,0 +1,15 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/onedotnet/asynctasks/taskmanager"
+)
+
+func GetBrokerStatus(c *gin.Context) {
+	if taskmanager.DefaultBroker == nil {
+		c.JSON(503, gin.H{"error": "broker not started"})
+		return
+	}
+
+	c.JSON(200, gin.H{"broker": taskmanager.DefaultBroker.Status()})
+}
@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/onedotnet/asynctasks/taskmanager"
+	"gorm.io/gorm"
+)
+
+// maxDeadLetterLimit caps the page size of ListDeadLetters; larger limits are clamped.
+const maxDeadLetterLimit = 1000
+
+func ListDeadLetters(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		c.JSON(400, gin.H{"error": "limit must be a positive integer"})
+		return
+	}
+	limit = min(limit, maxDeadLetterLimit)
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(400, gin.H{"error": "offset must be a non-negative integer"})
+		return
+	}
+
+	tasks, err := taskmanager.GetDeadLetteredTasks(limit, offset)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"tasks": tasks})
+}
+
+func GetDeadLetter(c *gin.Context) {
+	uid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	task, err := taskmanager.GetDeadLetteredTask(uid)
+	if err != nil {
+		deadLetterError(c, err)
+		return
+	}
+
+	c.JSON(200, gin.H{"task": task})
+}
+
+func RedriveDeadLetter(c *gin.Context) {
+	uid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	task, err := taskmanager.GetDeadLetteredTask(uid)
+	if err != nil {
+		deadLetterError(c, err)
+		return
+	}
+
+	outbox, err := task.Redrive(c.Request.Context())
+	if err != nil {
+		c.JSON(500, gin.H{"redrive task error": err.Error()})
+		return
+	}
+	if outbox.SentAt == nil {
+		// Written to the outbox; the relay keeps retrying the publish.
+		c.JSON(202, gin.H{"task": task, "outbox": outbox})
+		return
+	}
+
+	c.JSON(200, gin.H{"task": task, "node": outbox.Route})
+}
+
+// deadLetterError maps a GetDeadLetteredTask error: 404 when the task does not
+// exist or is not dead-lettered, 500 for anything else.
+func deadLetterError(c *gin.Context, err error) {
+	if errors.Is(err, gorm.ErrRecordNotFound) || errors.Is(err, taskmanager.ErrNotDeadLettered) {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(500, gin.H{"error": err.Error()})
+}
@@ -3,7 +3,7 @@ package handler
 import (
 	"bytes"
 	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
 	"image/jpeg"
@@ -61,17 +61,25 @@ func imageDecode(i string) (image.Image, string, error) {
 // 3. Decodes the base64 image string to an image object.
 // 4. Creates a directory for today's date if it doesn't exist.
 // 5. Generates a unique filename for the image and saves it to the directory.
-// 6. Creates a new task with the image information and saves it to the database.
-// 7. Publishes the task to the task queue.
+// 6. Creates a new task with the image information and writes it to the database
+// together with an outbox message in a single transaction.
+// 7. Publishes the outbox message and waits for the broker to confirm it,
+// unless run_at/delay_seconds defer it, in which case the scheduler dispatches it later.
 // 8. Returns the created task in the response.
 //
+// The optional priority is capped by the limit configured for the X-API-Key header.
+// The optional deadline or timeout_seconds expires the task if it has not finished by then;
+// workers drop its message and the task becomes expired.
+//
 // Parameters:
 // - c: The Gin context, which provides request and response handling.
 //
 // Responses:
-// - 200: Successfully created the task and returns the task information.
+// - 200: Successfully created the task and the broker confirmed it.
+// - 202: The task was created but publishing failed; the outbox relay will retry it.
+// - 410: The deadline passed before the task could be published; it is marked expired.
+// - 500: No capable node could route the task (it is marked failed), or any other step failed.
 // - 400: Bad request, returns an error message if the JSON binding or image decoding fails.
-// - 500: Internal server error, returns an error message if any other step fails.
 func UploadTaskImage(c *gin.Context) {
 	// Code
 
@@ -79,23 +87,48 @@ func UploadTaskImage(c *gin.Context) {
 		Image        string `json:"image" binding:"required"`
 		BaseImageUrl string `json:"base_image_url" binding:"required"`
 		TaskType     string `json:"task_type" binding:"required"`
+		RunAt        int64  `json:"run_at"`
+		DelaySeconds int64  `json:"delay_seconds"`
+		// Deadline is an absolute unix time, TimeoutSeconds is relative to when the task is due
+		Deadline       int64 `json:"deadline"`
+		TimeoutSeconds int64 `json:"timeout_seconds"`
+		Priority       int   `json:"priority"`
 	}
 	if err := c.ShouldBindJSON(&img); err != nil {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
 
-	node, err := taskmanager.GetAvaliableTaskNode(img.TaskType)
-	if err != nil {
-		c.JSON(500, gin.H{"get avaliable task node error": err.Error()})
-		return
+	runAt := img.RunAt
+	if img.DelaySeconds > 0 {
+		runAt = time.Now().Unix() + img.DelaySeconds
 	}
 
-	if node == nil {
-		c.JSON(500, gin.H{"node is nil error": "no available node"})
+	deadline := img.Deadline
+	if img.TimeoutSeconds > 0 {
+		deadline = max(runAt, time.Now().Unix()) + img.TimeoutSeconds
+	}
+	if deadline > 0 && deadline <= max(runAt, time.Now().Unix()) {
+		c.JSON(400, gin.H{"error": "deadline must be after the time the task runs"})
 		return
 	}
 
+	// delayed tasks are dispatched by the scheduler once they are due
+	var node *taskmanager.TaskNode
+	if runAt <= time.Now().Unix() {
+		var err error
+		node, err = taskmanager.GetAvaliableTaskNode(img.TaskType)
+		if err != nil {
+			c.JSON(500, gin.H{"get avaliable task node error": err.Error()})
+			return
+		}
+
+		if node == nil {
+			c.JSON(500, gin.H{"node is nil error": "no available node"})
+			return
+		}
+	}
+
 	imgI, ext, err := imageDecode(img.Image)
 	if err != nil {
 		c.JSON(400, gin.H{"error": err.Error()})
@@ -136,8 +169,14 @@ func UploadTaskImage(c *gin.Context) {
 	task := taskmanager.Task{
 		Name:      "Image Task",
 		TaskType:  img.TaskType,
-		Status:    "Pending",
+		Status:    taskmanager.TASK_PENDING,
 		MessageID: taskid,
+		RunAt:     runAt,
+		Deadline:  deadline,
+		Priority:  taskPriority(c, img.Priority),
+	}
+	if task.IsDelayed() {
+		task.Status = taskmanager.TASK_DELAYED
 	}
 
 	sourceUrl := fmt.Sprintf("%s/%s/%s", config.AppConfig.InstancePublicURL, todaypath, filename)
@@ -148,15 +187,41 @@ func UploadTaskImage(c *gin.Context) {
 	}}
 	// Code
 
-	err = taskmanager.CreateTask(&task)
+	if node == nil {
+		err = taskmanager.CreateTask(&task)
+		if err != nil {
+			c.JSON(500, gin.H{"create task error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"task": task})
+		return
+	}
+
+	trace := map[string]string{}
+	for _, h := range taskmanager.TraceHeaders() {
+		trace[h] = c.GetHeader(h)
+	}
+	outbox, err := taskmanager.CreateTaskWithOutbox(&task, node.Name, trace)
 	if err != nil {
 		c.JSON(500, gin.H{"create task error": err.Error()})
 		return
 	}
-
-	q := taskmanager.DefaultQueueProvider
-	j, _ := json.Marshal(task)
-	q.PublishTo(node.Name, j)
+	if err := outbox.Relay(c.Request.Context()); err != nil {
+		if errors.Is(err, taskmanager.ErrTaskExpired) {
+			// the deadline passed before the task could be published, it has been marked expired
+			task.Status = taskmanager.TASK_EXPIRED
+			c.JSON(410, gin.H{"task": task, "publish task error": err.Error()})
+			return
+		}
+		if errors.Is(err, taskmanager.ErrUnroutable) {
+			// no node could route the task, it has been marked failed
+			c.JSON(500, gin.H{"publish task error": err.Error()})
+			return
+		}
+		// the outbox relay keeps retrying, the task is not lost
+		c.JSON(202, gin.H{"task": task, "publish task warning": err.Error()})
+		return
+	}
 
 	c.JSON(200, gin.H{"task": task})
 
@@ -0,0 +1,23 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/onedotnet/asynctasks/config"
+	"github.com/onedotnet/asynctasks/taskmanager"
+)
+
+// taskPriority caps the requested priority to what the caller's X-API-Key
+// is allowed and to taskmanager.MaxTaskPriority.
+func taskPriority(c *gin.Context, requested int) uint8 {
+	max := config.AppConfig.MaxPriority(c.GetHeader("X-API-Key"))
+	if max > taskmanager.MaxTaskPriority {
+		max = taskmanager.MaxTaskPriority
+	}
+	if requested > max {
+		requested = max
+	}
+	if requested < 0 {
+		requested = 0
+	}
+	return uint8(requested)
+}
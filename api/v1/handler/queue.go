@@ -0,0 +1,23 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/onedotnet/asynctasks/taskmanager"
+)
+
+// ListQueues returns the message and consumer counts of the default queue
+// and of every task node queue.
+func ListQueues(c *gin.Context) {
+	if taskmanager.DefaultBroker == nil {
+		c.JSON(503, gin.H{"error": "broker not started"})
+		return
+	}
+
+	queues, err := taskmanager.InspectQueues()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error(), "queues": queues})
+		return
+	}
+
+	c.JSON(200, gin.H{"queues": queues})
+}
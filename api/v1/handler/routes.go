@@ -12,6 +12,10 @@ func Init(rg *gin.RouterGroup) {
 		})
 	})
 
+	// broker routes
+	rg.GET("/broker/status", GetBrokerStatus)
+	rg.GET("/queues", ListQueues)
+
 	// node routes
 	rg.POST("/node/keepalive", NodeKeepAlive)
 
@@ -22,4 +26,19 @@ func Init(rg *gin.RouterGroup) {
 	// task routes
 	rg.POST("/task/update", UpdateTask)
 	rg.GET("/task/:id", GetTask)
+	rg.GET("/task/:id/events", GetTaskEvents)
+	rg.POST("/task/:id/cancel", CancelTask)
+	rg.POST("/task/:id/cancel/ack", AckCancelTask)
+	rg.POST("/task/:id/pause", PauseTask)
+	rg.POST("/task/:id/resume", ResumeTask)
+
+	// task type routes
+	rg.GET("/task-type/paused", ListPausedTaskTypes)
+	rg.POST("/task-type/:type/pause", PauseTaskType)
+	rg.POST("/task-type/:type/resume", ResumeTaskType)
+
+	// dead letter routes
+	rg.GET("/deadletter", ListDeadLetters)
+	rg.GET("/deadletter/:id", GetDeadLetter)
+	rg.POST("/deadletter/:id/redrive", RedriveDeadLetter)
 }
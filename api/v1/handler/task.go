@@ -1,9 +1,12 @@
 package handler
 
 import (
+	"errors"
+
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/onedotnet/asynctasks/taskmanager"
+	"gorm.io/gorm"
 )
 
 func UpdateTask(c *gin.Context) {
@@ -13,8 +16,19 @@ func UpdateTask(c *gin.Context) {
 		return
 	}
 
-	if err := task.Update(); err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+	// only the reported status, node, errors and payload are applied;
+	// a failed report goes through the retry engine
+	if err := task.Report(taskmanager.ActorNode); err != nil {
+		switch {
+		case errors.Is(err, taskmanager.ErrUnknownTaskStatus):
+			c.JSON(400, gin.H{"error": err.Error()})
+		case errors.Is(err, taskmanager.ErrIllegalTransition):
+			c.JSON(409, gin.H{"error": err.Error()})
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(404, gin.H{"error": err.Error()})
+		default:
+			c.JSON(500, gin.H{"error": err.Error()})
+		}
 		return
 	}
 
@@ -37,3 +51,189 @@ func GetTask(c *gin.Context) {
 
 	c.JSON(200, gin.H{"task": task})
 }
+
+func GetTaskEvents(c *gin.Context) {
+	uid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	task, err := taskmanager.GetTaskByUUID(uid)
+	if err != nil {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	}
+
+	events, err := taskmanager.GetTaskEvents(task.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	cancellations, err := taskmanager.GetTaskCancellations(task.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"task": task, "events": events, "cancellations": cancellations})
+}
+
+// CancelTask marks a task cancelled. If the task's message has reached a node,
+// the node is told over its control exchange to stop the task or to skip the
+// still-queued message.
+//
+// Responses:
+// - 200: The task is cancelled and, if it was on a node, the node has been notified.
+// - 202: The task is cancelled but notifying the node failed; it will be resent.
+// - 404: The task does not exist.
+// - 409: The task has already finished and cannot be cancelled.
+func CancelTask(c *gin.Context) {
+	uid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	task, err := taskmanager.GetTaskByUUID(uid)
+	if err != nil {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	}
+
+	cancellation, err := task.Cancel(c.Request.Context(), taskmanager.ActorAPI, req.Reason)
+	if err != nil {
+		if errors.Is(err, taskmanager.ErrIllegalTransition) {
+			c.JSON(409, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(500, gin.H{"cancel task error": err.Error()})
+		return
+	}
+	if cancellation != nil && cancellation.SentAt == nil {
+		c.JSON(202, gin.H{"task": task, "cancellation": cancellation})
+		return
+	}
+
+	c.JSON(200, gin.H{"task": task, "cancellation": cancellation})
+}
+
+// AckCancelTask records that a node has acted on a cancel control message.
+func AckCancelTask(c *gin.Context) {
+	uid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	var req struct {
+		Node    string `json:"node" binding:"required"`
+		Message string `json:"message"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	cancellation, err := taskmanager.AckCancellation(uid, req.Node, req.Message)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(404, gin.H{"error": "no cancellation sent to this node"})
+			return
+		}
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"cancellation": cancellation})
+}
+
+// PauseTask holds a task whose message has not reached a node yet. The
+// message stays in the outbox at its original position until the task is
+// resumed.
+//
+// Responses:
+// - 200: The task is paused.
+// - 409: The task cannot be paused, or its message is already on a node.
+func PauseTask(c *gin.Context) {
+	uid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	task, err := taskmanager.GetTaskByUUID(uid)
+	if err != nil {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := task.Pause(taskmanager.ActorAPI, req.Reason); err != nil {
+		if errors.Is(err, taskmanager.ErrIllegalTransition) || errors.Is(err, taskmanager.ErrTaskQueued) {
+			c.JSON(409, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(500, gin.H{"pause task error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"task": task})
+}
+
+// ResumeTask releases a paused task's held outbox message, or hands a task
+// that was delayed or retrying back to the scheduler.
+//
+// Responses:
+// - 200: The task was published, or is delayed until its run_at.
+// - 202: The task is queued in the outbox; the relay will publish it.
+// - 409: The task is not paused.
+func ResumeTask(c *gin.Context) {
+	uid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	task, err := taskmanager.GetTaskByUUID(uid)
+	if err != nil {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	}
+
+	outbox, err := task.Resume(c.Request.Context(), taskmanager.ActorAPI)
+	if err != nil {
+		if errors.Is(err, taskmanager.ErrIllegalTransition) {
+			c.JSON(409, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(500, gin.H{"resume task error": err.Error()})
+		return
+	}
+	if outbox != nil && outbox.SentAt == nil {
+		c.JSON(202, gin.H{"task": task, "outbox": outbox})
+		return
+	}
+
+	c.JSON(200, gin.H{"task": task})
+}
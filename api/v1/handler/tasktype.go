@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+	"github.com/onedotnet/asynctasks/taskmanager"
+	"gorm.io/gorm"
+)
+
+func ListPausedTaskTypes(c *gin.Context) {
+	pauses, err := taskmanager.GetPausedTaskTypes()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"paused": pauses})
+}
+
+// PauseTaskType stops dispatching tasks of one type, e.g. during model
+// maintenance. New and pending tasks are held in the outbox, not dropped.
+func PauseTaskType(c *gin.Context) {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	pause, err := taskmanager.PauseTaskType(c.Param("type"), taskmanager.ActorAPI, req.Reason)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"paused": pause})
+}
+
+// ResumeTaskType resumes dispatching a paused task type; held tasks are
+// published in the order they were submitted.
+func ResumeTaskType(c *gin.Context) {
+	if err := taskmanager.ResumeTaskType(c.Param("type")); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(404, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"resumed": c.Param("type")})
+}
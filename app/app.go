@@ -0,0 +1,70 @@
+package app
+
+import (
+	"log/slog"
+
+	"github.com/onedotnet/asynctasks/config"
+	"github.com/onedotnet/asynctasks/database"
+	"github.com/onedotnet/asynctasks/taskmanager"
+	"gorm.io/gorm"
+)
+
+// App owns the configuration and the connections a command needs.
+// Connections are opened on first use, so each command only dials what it actually uses.
+type App struct {
+	Config *config.Config
+
+	db     *gorm.DB
+	broker taskmanager.Broker
+}
+
+// New loads the configuration without opening any connection.
+func New() (*App, error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, err
+	}
+	return &App{Config: cfg}, nil
+}
+
+// DB opens the database connection if it is not open yet.
+func (a *App) DB() (*gorm.DB, error) {
+	if a.db != nil {
+		return a.db, nil
+	}
+	db, err := database.Open(a.Config)
+	if err != nil {
+		return nil, err
+	}
+	a.db = db
+	return db, nil
+}
+
+// Broker connects to the message broker if it is not connected yet.
+func (a *App) Broker() (taskmanager.Broker, error) {
+	if a.broker != nil {
+		return a.broker, nil
+	}
+	broker, err := taskmanager.StartDefaultBroker()
+	if err != nil {
+		return nil, err
+	}
+	a.broker = broker
+	return broker, nil
+}
+
+// Close releases every connection the App opened.
+func (a *App) Close() {
+	if a.broker != nil {
+		if err := a.broker.Close(); err != nil {
+			slog.Error("close broker failed", "error", err)
+		}
+		a.broker = nil
+	}
+	if a.db != nil {
+		if err := database.Close(); err != nil {
+			slog.Error("close database failed", "error", err)
+		}
+		a.db = nil
+	}
+}
@@ -3,19 +3,26 @@ package cmd
 import (
 	"log/slog"
 
-	"github.com/onedotnet/asynctasks/database"
+	"github.com/onedotnet/asynctasks/app"
 	"github.com/onedotnet/asynctasks/taskmanager"
 	"github.com/spf13/cobra"
+	"gorm.io/gorm"
 )
 
 var tableList = map[string]interface{}{
-	"node": taskmanager.TaskNode{},
-	"task": taskmanager.Task{},
+	"node":              taskmanager.TaskNode{},
+	"task":              taskmanager.Task{},
+	"task_event":        taskmanager.TaskEvent{},
+	"task_cancellation": taskmanager.TaskCancellation{},
+	"task_type_pause":   taskmanager.TaskTypePause{},
+	"outbox":            taskmanager.OutboxMessage{},
+	"queue_message":     taskmanager.QueueMessage{},
+	"queue_binding":     taskmanager.QueueBinding{},
+	"processed_message": taskmanager.ProcessedMessage{},
 }
 
-func migrate() {
+func migrate(db *gorm.DB) {
 	slog.Info("Migrating database...")
-	db := database.DB()
 	for tablename, table := range tableList {
 		slog.Info("Creating table ", "tablename=", tablename)
 		db.AutoMigrate(table)
@@ -27,8 +34,19 @@ func migrate() {
 var migrateCmd = &cobra.Command{
 	Use:   "migrate",
 	Short: "Migrate the database",
-	Run: func(cmd *cobra.Command, args []string) {
-		migrate()
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a, err := app.New()
+		if err != nil {
+			return err
+		}
+		defer a.Close()
+
+		db, err := a.DB()
+		if err != nil {
+			return err
+		}
+		migrate(db)
+		return nil
 	},
 }
 
@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/onedotnet/asynctasks/app"
+	"github.com/onedotnet/asynctasks/taskmanager"
+	"github.com/spf13/cobra"
+)
+
+var pingCmd = &cobra.Command{
+	Use:   "ping",
+	Short: "Check the connection to every configured message broker",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a, err := app.New()
+		if err != nil {
+			return err
+		}
+		defer a.Close()
+
+		var failed error
+		for _, addr := range taskmanager.BrokerURLs(a.Config) {
+			conn, err := taskmanager.DialBroker(a.Config, addr)
+			if err != nil {
+				fmt.Printf("%s: %v\n", taskmanager.RedactURL(addr), err)
+				failed = fmt.Errorf("some brokers are unreachable")
+				continue
+			}
+			conn.Close()
+			fmt.Printf("%s: ok\n", taskmanager.RedactURL(addr))
+		}
+		return failed
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(pingCmd)
+}
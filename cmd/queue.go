@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/onedotnet/asynctasks/app"
+	"github.com/onedotnet/asynctasks/taskmanager"
+	"github.com/spf13/cobra"
+)
+
+var queueCmd = &cobra.Command{
+	Use:   "queue",
+	Short: "Inspect the message queues",
+}
+
+var queueLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List the default and per-node queues with message and consumer counts",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a, err := app.New()
+		if err != nil {
+			return err
+		}
+		defer a.Close()
+
+		if _, err := a.DB(); err != nil {
+			return err
+		}
+		// only read the queues: no topology is declared and nothing is consumed
+		broker, err := taskmanager.NewDefaultBroker()
+		if err != nil {
+			return err
+		}
+		var inspector taskmanager.QueueInspector
+		switch b := broker.(type) {
+		case *taskmanager.PostgresBroker:
+			inspector = b
+		default:
+			amqpInspector, err := taskmanager.DialAMQPInspector(a.Config)
+			if err != nil {
+				return err
+			}
+			defer amqpInspector.Close()
+			inspector = amqpInspector
+		}
+
+		queues, err := taskmanager.InspectQueuesWith(inspector, taskmanager.DefaultQueueNames(broker))
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "QUEUE\tNODE\tMESSAGES\tCONSUMERS\tERROR")
+		for _, q := range queues {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\n", q.Name, q.Node, q.Messages, q.Consumers, q.Error)
+		}
+		w.Flush()
+		return err
+	},
+}
+
+func init() {
+	queueCmd.AddCommand(queueLsCmd)
+	rootCmd.AddCommand(queueCmd)
+}
@@ -8,12 +8,20 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/onedotnet/asynctasks/api/v1/handler"
+	"github.com/onedotnet/asynctasks/app"
 	"github.com/onedotnet/asynctasks/config"
 	"github.com/onedotnet/asynctasks/taskmanager"
 	"github.com/spf13/cobra"
 )
 
-func start() {
+func start(a *app.App) error {
+	if _, err := a.DB(); err != nil {
+		return err
+	}
+	if _, err := a.Broker(); err != nil {
+		return err
+	}
+
 	r := gin.Default()
 	r.Use(gin.Recovery(), cors.New(cors.Config{
 		AllowOrigins: []string{"*"},
@@ -35,15 +43,20 @@ func start() {
 	addr := fmt.Sprintf("%s:%d", config.AppConfig.ListenHost, config.AppConfig.ListenPort)
 	// Start the background services
 	taskmanager.StartBackGroundServices()
-	r.Run(addr)
-
+	return r.Run(addr)
 }
 
 var startCMD = &cobra.Command{
 	Use:   "start",
 	Short: "Start the server",
-	Run: func(cmd *cobra.Command, args []string) {
-		start()
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a, err := app.New()
+		if err != nil {
+			return err
+		}
+		defer a.Close()
+
+		return start(a)
 	},
 }
 
@@ -1,16 +1,24 @@
 package cmd
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 
+	"github.com/onedotnet/asynctasks/app"
 	"github.com/onedotnet/asynctasks/database"
 	"github.com/onedotnet/asynctasks/taskmanager"
 	"github.com/spf13/cobra"
 )
 
-func makeatask() {
+func makeatask(a *app.App) error {
 	// Code
+	if _, err := a.DB(); err != nil {
+		return err
+	}
+	q, err := a.Broker()
+	if err != nil {
+		return err
+	}
 
 	roopTask := taskmanager.TaskRoop{
 		Source: "http://example.com",
@@ -20,7 +28,7 @@ func makeatask() {
 
 	task := taskmanager.Task{
 		Name:     "Test Task",
-		Status:   "Pending",
+		Status:   taskmanager.TASK_PENDING,
 		Payload:  database.JSONB{"payload": roopTask},
 		TaskType: taskmanager.TASK_TYPE_ROOP,
 	}
@@ -28,24 +36,30 @@ func makeatask() {
 
 	node, err := taskmanager.GetAvaliableTaskNode("roop")
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
 	if node != nil {
 		fmt.Println(node.Name)
 	}
 
-	q := taskmanager.DefaultQueueProvider
-	j, _ := json.Marshal(task)
-	q.PublishTo(node.Name, j)
-
+	env, err := taskmanager.NewTaskEnvelope(&task)
+	if err != nil {
+		return err
+	}
+	return q.PublishMessage(context.Background(), node.Name, env.Message())
 }
 
 var makeataskCmd = &cobra.Command{
 	Use:   "newtask",
 	Short: "Make a task",
-	Run: func(cmd *cobra.Command, args []string) {
-		makeatask()
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a, err := app.New()
+		if err != nil {
+			return err
+		}
+		defer a.Close()
+
+		return makeatask(a)
 	},
 }
 
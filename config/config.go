@@ -1,6 +1,15 @@
 package config
 
-import "github.com/spf13/viper"
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
 
 var AppConfig *Config
 
@@ -18,6 +27,42 @@ type Config struct {
 	RMQPass            string `mapstructure:"RABBITMQ_PASS"`
 	RMQVHost           string `mapstructure:"RABBITMQ_VHOST"`
 	RMQChannelPoolSize int    `mapstructure:"RABBITMQ_CHANNEL_POOL_SIZE"`
+	// Cluster nodes as host[:port] list: "rmq1:5672,rmq2,rmq3", overrides RABBITMQ_HOST
+	RMQHosts string `mapstructure:"RABBITMQ_HOSTS"`
+	// Queue backend: "rabbitmq" (default) or "postgres"
+	QueueBackend string `mapstructure:"QUEUE_BACKEND"`
+	// Seconds a message claimed from the postgres queue stays hidden from other consumers
+	PGQueueVisibilityTimeout int `mapstructure:"PG_QUEUE_VISIBILITY_TIMEOUT"`
+	// Seconds a processed message ID is remembered by the consumer idempotency guard
+	IdempotencyTTL int `mapstructure:"IDEMPOTENCY_TTL"`
+	// Message body compression on publish: "" (off), "gzip" or "zstd"
+	MessageCompression string `mapstructure:"MESSAGE_COMPRESSION"`
+	// Bodies smaller than this many bytes are published uncompressed
+	MessageCompressionThreshold int `mapstructure:"MESSAGE_COMPRESSION_THRESHOLD"`
+	// Full broker URI (amqp:// or amqps://), comma separated for a cluster,
+	// overrides host/port/user/pass/vhost
+	RMQURL string `mapstructure:"RABBITMQ_URL"`
+	// Use amqps when the URI is built from host/port
+	RMQTLS bool `mapstructure:"RABBITMQ_TLS"`
+	// PEM files for TLS: CA to verify the broker, client cert/key for mutual TLS
+	RMQCACert        string `mapstructure:"RABBITMQ_CA_CERT"`
+	RMQClientCert    string `mapstructure:"RABBITMQ_CLIENT_CERT"`
+	RMQClientKey     string `mapstructure:"RABBITMQ_CLIENT_KEY"`
+	RMQTLSServerName string `mapstructure:"RABBITMQ_TLS_SERVER_NAME"`
+	// Publisher confirm timeout in seconds
+	RMQConfirmTimeout int `mapstructure:"RABBITMQ_CONFIRM_TIMEOUT"`
+	// Declare durable exchanges/queues and publish persistent messages
+	RMQDurable    bool `mapstructure:"RABBITMQ_DURABLE"`
+	RMQPersistent bool `mapstructure:"RABBITMQ_PERSISTENT"`
+	RMQDeadLetter bool `mapstructure:"RABBITMQ_DEAD_LETTER"`
+	// Max redeliveries of a message that is not a task before it is quarantined, 0 disables the limit
+	RMQMaxRedelivery int `mapstructure:"RABBITMQ_MAX_REDELIVERY"`
+	// Number of concurrent message handlers per queue, also used as the prefetch count
+	RMQWorkers int `mapstructure:"RABBITMQ_WORKERS"`
+	// Max messages buffered by PublishTo while disconnected, 0 disables buffering
+	RMQPublishBuffer int `mapstructure:"RABBITMQ_PUBLISH_BUFFER"`
+	// Upper bound of the reconnect backoff in seconds
+	RMQReconnectMaxDelay int `mapstructure:"RABBITMQ_RECONNECT_MAX_DELAY"`
 
 	ListenPort      int    `mapstructure:"LISTEN_PORT"`
 	ListenHost      string `mapstructure:"LISTEN_HOST"`
@@ -25,6 +70,22 @@ type Config struct {
 	APIServcieToken string `mapstructure:"API_SERVICE_TOKEN"`
 	APIMagicPath    string `mapstructure:"API_MAGIC_PATH"`
 
+	// Highest task priority a request may ask for, per X-API-Key: "key1:10,key2:5"
+	APIKeyPriorities string `mapstructure:"API_KEY_PRIORITIES"`
+	// Highest task priority for requests without a known API key (default 5, 0 disables priority)
+	DefaultMaxPriority int `mapstructure:"DEFAULT_MAX_PRIORITY"`
+
+	// Backoff between automatic retries of a failed task, per task type:
+	// "type:strategy:base[:max]" with strategy fixed, exponential or jitter and delays in seconds,
+	// e.g. "roop:exponential:5:300,video:fixed:60"
+	RetryPolicies string `mapstructure:"RETRY_POLICIES"`
+	// Policy for task types not listed in RETRY_POLICIES
+	RetryStrategy  string `mapstructure:"RETRY_STRATEGY"`
+	RetryBaseDelay int    `mapstructure:"RETRY_BASE_DELAY"`
+	RetryMaxDelay  int    `mapstructure:"RETRY_MAX_DELAY"`
+	// Status of a task whose retries are exhausted: "dead_lettered" (default) or "failed"
+	RetryExhaustedStatus string `mapstructure:"RETRY_EXHAUSTED_STATUS"`
+
 	// Session timeout in seconds
 	SessionTimeout int `mapstructure:"SESSION_TIMEOUT"`
 
@@ -45,7 +106,9 @@ type Config struct {
 	ClusterPublicURL  string `mapstructure:"CLUSTER_PUBLIC_URL"`
 }
 
-func NewConfig() *Config {
+// Load reads .env (if present) and environment variables into AppConfig.
+// A missing .env is not an error; every setting can come from the environment.
+func Load() (*Config, error) {
 	config := &Config{}
 	viper.AddConfigPath(".")
 	viper.AddConfigPath("../")
@@ -53,18 +116,133 @@ func NewConfig() *Config {
 	viper.AddConfigPath("/etc/onedotnet/asynctasks/")
 	viper.AddConfigPath("$HOME/.onedotnet/asynctasks/")
 	viper.SetConfigFile(".env")
+	viper.SetDefault("QUEUE_BACKEND", "rabbitmq")
+	viper.SetDefault("RABBITMQ_DEAD_LETTER", true)
+	viper.SetDefault("MESSAGE_COMPRESSION_THRESHOLD", 1024)
+	viper.SetDefault("RABBITMQ_WORKERS", 10)
+	viper.SetDefault("RABBITMQ_MAX_REDELIVERY", 10)
+	viper.SetDefault("DEFAULT_MAX_PRIORITY", 5)
+	viper.SetDefault("RETRY_STRATEGY", "exponential")
+	viper.SetDefault("RETRY_BASE_DELAY", 5)
+	viper.SetDefault("RETRY_MAX_DELAY", 300)
+	viper.SetDefault("RETRY_EXHAUSTED_STATUS", "dead_lettered")
+	bindEnv(reflect.TypeOf(*config))
 
-	if err := viper.ReadInConfig(); err != nil {
-		panic(err)
+	if err := viper.ReadInConfig(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
 	}
 
 	if err := viper.Unmarshal(config); err != nil {
-		panic(err)
+		return nil, err
 	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	AppConfig = config
+	return config, nil
+}
 
+// validate rejects settings that would otherwise fail, or be silently replaced, at run time.
+func (c *Config) validate() error {
+	switch c.MessageCompression {
+	case "", "gzip", "zstd":
+	default:
+		return fmt.Errorf("invalid MESSAGE_COMPRESSION %q: want empty, gzip or zstd", c.MessageCompression)
+	}
+	if c.RMQWorkers < 1 {
+		return fmt.Errorf("invalid RABBITMQ_WORKERS %d: want at least 1", c.RMQWorkers)
+	}
+	if c.RMQMaxRedelivery < 0 {
+		return fmt.Errorf("invalid RABBITMQ_MAX_REDELIVERY %d: want 0 (unlimited) or more", c.RMQMaxRedelivery)
+	}
+	if c.RMQPublishBuffer < 0 {
+		return fmt.Errorf("invalid RABBITMQ_PUBLISH_BUFFER %d: want 0 (off) or more", c.RMQPublishBuffer)
+	}
+	// Task priorities go up to taskmanager.MaxTaskPriority.
+	if c.DefaultMaxPriority < 0 || c.DefaultMaxPriority > 10 {
+		return fmt.Errorf("invalid DEFAULT_MAX_PRIORITY %d: want 0 (off) to 10", c.DefaultMaxPriority)
+	}
+	if c.RetryBaseDelay <= 0 {
+		return fmt.Errorf("invalid RETRY_BASE_DELAY %d: want a positive number of seconds", c.RetryBaseDelay)
+	}
+	if c.RetryMaxDelay < c.RetryBaseDelay {
+		return fmt.Errorf("invalid RETRY_MAX_DELAY %d: want at least RETRY_BASE_DELAY (%d)", c.RetryMaxDelay, c.RetryBaseDelay)
+	}
+	if !validRetryStrategy(c.RetryStrategy) {
+		return fmt.Errorf("invalid RETRY_STRATEGY %q: want fixed, exponential or jitter", c.RetryStrategy)
+	}
+	for _, entry := range strings.Split(c.RetryPolicies, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) < 3 || len(parts) > 4 || parts[0] == "" {
+			return fmt.Errorf("invalid RETRY_POLICIES entry %q: want type:strategy:base[:max]", entry)
+		}
+		if !validRetryStrategy(parts[1]) {
+			return fmt.Errorf("invalid RETRY_POLICIES entry %q: strategy must be fixed, exponential or jitter", entry)
+		}
+		delays := make([]int, 0, 2)
+		for _, delay := range parts[2:] {
+			n, err := strconv.Atoi(delay)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid RETRY_POLICIES entry %q: delays must be positive seconds", entry)
+			}
+			delays = append(delays, n)
+		}
+		if len(delays) == 2 && delays[1] < delays[0] {
+			return fmt.Errorf("invalid RETRY_POLICIES entry %q: max delay is below the base delay", entry)
+		}
+	}
+	switch c.RetryExhaustedStatus {
+	case "dead_lettered", "failed":
+	default:
+		return fmt.Errorf("invalid RETRY_EXHAUSTED_STATUS %q: want dead_lettered or failed", c.RetryExhaustedStatus)
+	}
+	return nil
+}
+
+// validRetryStrategy reports whether s is a known retry backoff strategy.
+func validRetryStrategy(s string) bool {
+	switch s {
+	case "fixed", "exponential", "jitter":
+		return true
+	}
+	return false
+}
+
+// NewConfig is Load that panics on error.
+func NewConfig() *Config {
+	config, err := Load()
+	if err != nil {
+		panic(err)
+	}
 	return config
 }
 
-func init() {
-	AppConfig = NewConfig()
+// bindEnv lets viper read every mapstructure key from the environment.
+func bindEnv(t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		if key := t.Field(i).Tag.Get("mapstructure"); key != "" {
+			viper.BindEnv(key)
+		}
+	}
+}
+
+// MaxPriority returns the highest task priority allowed for apiKey,
+// falling back to DefaultMaxPriority for unknown or empty keys.
+func (c *Config) MaxPriority(apiKey string) int {
+	if apiKey != "" {
+		for _, entry := range strings.Split(c.APIKeyPriorities, ",") {
+			key, max, ok := strings.Cut(strings.TrimSpace(entry), ":")
+			if !ok || key != apiKey {
+				continue
+			}
+			if n, err := strconv.Atoi(max); err == nil {
+				return n
+			}
+		}
+	}
+	return c.DefaultMaxPriority
 }
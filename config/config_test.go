@@ -0,0 +1,57 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+// validConfig returns the defaults Load sets, which must pass validate.
+func validConfig() Config {
+	return Config{
+		RMQWorkers:           10,
+		RMQMaxRedelivery:     10,
+		DefaultMaxPriority:   5,
+		RetryStrategy:        "exponential",
+		RetryBaseDelay:       5,
+		RetryMaxDelay:        300,
+		RetryExhaustedStatus: "dead_lettered",
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		want   string
+	}{
+		{"defaults", func(c *Config) {}, ""},
+		{"zstd", func(c *Config) { c.MessageCompression = "zstd" }, ""},
+		{"unknown compression", func(c *Config) { c.MessageCompression = "lz4" }, "MESSAGE_COMPRESSION"},
+		{"no workers", func(c *Config) { c.RMQWorkers = 0 }, "RABBITMQ_WORKERS"},
+		{"unlimited redelivery", func(c *Config) { c.RMQMaxRedelivery = 0 }, ""},
+		{"negative redelivery", func(c *Config) { c.RMQMaxRedelivery = -1 }, "RABBITMQ_MAX_REDELIVERY"},
+		{"negative publish buffer", func(c *Config) { c.RMQPublishBuffer = -1 }, "RABBITMQ_PUBLISH_BUFFER"},
+		{"priority off", func(c *Config) { c.DefaultMaxPriority = 0 }, ""},
+		{"priority too high", func(c *Config) { c.DefaultMaxPriority = 11 }, "DEFAULT_MAX_PRIORITY"},
+		{"zero base delay", func(c *Config) { c.RetryBaseDelay = 0 }, "RETRY_BASE_DELAY"},
+		{"max below base", func(c *Config) { c.RetryMaxDelay = 1 }, "RETRY_MAX_DELAY"},
+		{"unknown strategy", func(c *Config) { c.RetryStrategy = "linear" }, "RETRY_STRATEGY"},
+		{"policies", func(c *Config) { c.RetryPolicies = "roop:exponential:5:300, video:fixed:60" }, ""},
+		{"policy strategy", func(c *Config) { c.RetryPolicies = "video:linear:60" }, "RETRY_POLICIES"},
+		{"policy format", func(c *Config) { c.RetryPolicies = "video:fixed" }, "RETRY_POLICIES"},
+		{"policy delay", func(c *Config) { c.RetryPolicies = "video:fixed:soon" }, "RETRY_POLICIES"},
+		{"policy max below base", func(c *Config) { c.RetryPolicies = "video:exponential:60:30" }, "RETRY_POLICIES"},
+		{"exhausted status", func(c *Config) { c.RetryExhaustedStatus = "cancelled" }, "RETRY_EXHAUSTED_STATUS"},
+	}
+	for _, tt := range tests {
+		c := validConfig()
+		tt.modify(&c)
+		err := c.validate()
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("%s: error = %v, want one mentioning %s", tt.name, err, tt.want)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package database
 
 import (
+	"context"
+	"database/sql/driver"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -29,26 +31,26 @@ func TimeNow() time.Time {
 	return time.Now().UTC()
 }
 
-func conn() (*gorm.DB, error) {
-	cfg := config.AppConfig
-	dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%d sslmode=%s TimeZone=Asia/Shanghai",
+// DSN returns the connection string for the database described by cfg.
+func DSN(cfg *config.Config) string {
+	return fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%d sslmode=%s TimeZone=Asia/Shanghai",
 		cfg.DBHost,
 		cfg.DBUser,
 		cfg.DBPassword,
 		cfg.DBName,
 		cfg.DBPort,
 		cfg.DBSSL)
+}
 
-	conn, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
+func conn(cfg *config.Config) (*gorm.DB, error) {
+	conn, err := gorm.Open(postgres.Open(DSN(cfg)), &gorm.Config{
 		//Logger: logger.Default.LogMode(logger.Info),
 	})
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 	sqlDB, err := conn.DB()
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 	//conn.Logger.LogMode(logger.Info)
@@ -62,13 +64,66 @@ func conn() (*gorm.DB, error) {
 
 var db *gorm.DB
 
+// Open connects to the database described by cfg and makes it the one returned by DB().
+func Open(cfg *config.Config) (*gorm.DB, error) {
+	conn, err := conn(cfg)
+	if err != nil {
+		return nil, err
+	}
+	db = conn
+	return db, nil
+}
+
+// Close closes the connection opened by Open or DB.
+func Close() error {
+	if db == nil {
+		return nil
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	db = nil
+	return sqlDB.Close()
+}
+
 func DB() *gorm.DB {
 	if db == nil {
-		conn, err := conn()
-		if err != nil {
+		if _, err := Open(config.AppConfig); err != nil {
 			log.Fatal(err)
 		}
-		db = conn
 	}
 	return db
 }
+
+// WithAdvisoryLock runs fn while holding the session-level advisory lock key
+// on a dedicated connection. It returns false without running fn when another
+// session holds the lock.
+func WithAdvisoryLock(ctx context.Context, key int64, fn func()) (bool, error) {
+	sqlDB, err := DB().DB()
+	if err != nil {
+		return false, err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&locked); err != nil {
+		return false, err
+	}
+	if !locked {
+		return false, nil
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", key); err != nil {
+			// never hand a connection that may still hold the lock back to the pool
+			log.Printf("advisory unlock %d failed: %v", key, err)
+			conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+	}()
+	fn()
+	return true, nil
+}
@@ -1,8 +1,12 @@
 package taskmanager
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/onedotnet/asynctasks/config"
@@ -19,6 +23,67 @@ const (
 	ExchangeTopic   = "topic"
 )
 
+const defaultConfirmTimeout = 5 * time.Second
+
+var (
+	// ErrPublishNacked broker 拒绝了消息(basic.nack)
+	ErrPublishNacked = errors.New("messaging queue - publish nacked by broker")
+	// ErrConfirmTimeout 在超时时间内没有收到 broker 的确认
+	ErrConfirmTimeout = errors.New("messaging queue - publish confirm timeout")
+	// ErrChannelClosed 等待确认时 channel 被关闭
+	ErrChannelClosed = errors.New("messaging queue - channel closed before confirm")
+	// ErrUnroutable 消息没有路由到任何队列, 被 broker 退回(basic.return)
+	ErrUnroutable = errors.New("messaging queue - message unroutable")
+)
+
+// QueueOptions 队列的可选配置
+type QueueOptions struct {
+	// Durable 声明持久化的 exchange 和 queue, broker 重启后不会丢失
+	Durable bool
+	// Persistent 以持久化模式(DeliveryMode=2)发布消息
+	Persistent bool
+	// DeadLetter 为队列声明死信 exchange/queue, 处理失败的任务消息转入死信队列, 由 manager 决定是否重试
+	DeadLetter bool
+	// Workers 同时处理消息的 goroutine 数量; 未通过 SetQOS 设置时也作为 prefetch 数量
+	Workers int
+	// MaxRedelivery 不是 Task 的消息(或未开启 DeadLetter 时)处理失败后最多重新投递的次数,
+	// 超过后转入隔离队列 <queue>.quarantine; 0 表示不限制, 一直 requeue
+	MaxRedelivery int
+	// Compression 发布时压缩消息体的算法(EncodingGzip/EncodingZstd), 空表示不压缩;
+	// 消费时总是按 ContentEncoding 解压
+	Compression string
+	// CompressionThreshold 小于该字节数的消息体不压缩
+	CompressionThreshold int
+	// KeepExpired 把 x-deadline 已过的消息也交给 handler; 默认直接 ack 丢弃, 死信记录队列需要处理它们
+	KeepExpired bool
+	// PublishBuffer 断线期间 PublishTo/PublishToExchange 最多缓存的消息数, 重连后依次补发; 0 表示不缓存
+	PublishBuffer int
+}
+
+// DefaultQueueOptions 从配置中读取默认的队列选项
+func DefaultQueueOptions() QueueOptions {
+	return QueueOptions{
+		Durable:    config.AppConfig.RMQDurable,
+		Persistent: config.AppConfig.RMQPersistent,
+		DeadLetter: config.AppConfig.RMQDeadLetter,
+		Workers:    config.AppConfig.RMQWorkers,
+
+		MaxRedelivery: config.AppConfig.RMQMaxRedelivery,
+		PublishBuffer: config.AppConfig.RMQPublishBuffer,
+
+		Compression:          config.AppConfig.MessageCompression,
+		CompressionThreshold: config.AppConfig.MessageCompressionThreshold,
+	}
+}
+
+// publishChannel 处于 confirm 模式的发布 channel
+// 发布时 mandatory=true, 无法路由的消息会先收到 basic.return 再收到确认
+type publishChannel struct {
+	channel  *amqp.Channel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+}
+
 // QueueProvider 结构
 type QueueProvider struct {
 	conn          *amqp.Connection
@@ -26,49 +91,87 @@ type QueueProvider struct {
 	connNotify    chan *amqp.Error
 	channelNotify chan *amqp.Error
 	quit          chan struct{}
-	addr          string
-	port          int
-	username      string
-	password      string
-	vhost         string
 	exchange      string
 	exchangeType  string
 	queue         string
 	routingKey    string
 	tag           string
 	autoDelete    bool
-	handler       func([]byte) error
 	qos           int
 	maxsize       int
 	args          map[string]interface{}
-	channelPool   chan *amqp.Channel
+	channelPool   chan *publishChannel
+	options       QueueOptions
+
+	confirmTimeout time.Duration
+
+	// ctx 与当前连接绑定, Stop() 或连接断开时取消, 传递给正在处理的消息
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// mu 保护 conn、channel、notify 和 ctx, 重连时整体替换
+	mu       sync.RWMutex
+	stopOnce sync.Once
+
+	// startMu 保护 started; Start 成功后由 ReConnect 负责重连, 不能再次进入 Run
+	startMu sync.Mutex
+	started bool
+
+	// handlerMu 保护 handler, Consume 可以在消费过程中替换它
+	handlerMu sync.RWMutex
+	handler   DeliveryHandler
+
+	statusMu sync.Mutex
+	status   BrokerStatus
+
+	bufferMu sync.Mutex
+	buffer   []bufferedPublish
+	// flushing 正在补发缓存, 期间新的发布排在缓存后面
+	flushing bool
+
+	maxReconnectDelay time.Duration
+
+	// endpoints 集群中所有 broker 的地址, 每次连接从 nextEndpoint 开始尝试
+	endpoints    []string
+	nextEndpoint int
 }
 
 // NewQueueProvider 返回一个新的队列结构
-func NewQueueProvider(exchange, exchangeKind, route, queue string, autoDelete bool, handler func([]byte) error) *QueueProvider {
+// opts 可选, 不传时使用 DefaultQueueOptions()
+func NewQueueProvider(exchange, exchangeKind, route, queue string, autoDelete bool, handler func([]byte) error, opts ...QueueOptions) *QueueProvider {
+	options := DefaultQueueOptions()
+	if len(opts) > 0 {
+		options = opts[0]
+	}
 	qp := &QueueProvider{
-		username:     config.AppConfig.RMQUser,
-		password:     config.AppConfig.RMQPass,
-		vhost:        config.AppConfig.RMQVHost,
-		addr:         config.AppConfig.RMQHost,
-		port:         config.AppConfig.RMQPort,
 		exchange:     exchange,
 		exchangeType: exchangeKind,
 		routingKey:   route,
 		queue:        queue,
 		tag:          "",
 		autoDelete:   autoDelete,
-		handler:      handler,
+		handler:      AdaptHandler(handler),
 		quit:         make(chan struct{}),
 		qos:          0,
 		maxsize:      0,
 		args:         nil,
+		options:      options,
 	}
 	channelPoolSize := 3
 	if config.AppConfig.RMQChannelPoolSize > 0 {
 		channelPoolSize = config.AppConfig.RMQChannelPoolSize
 	}
-	qp.channelPool = make(chan *amqp.Channel, channelPoolSize)
+	qp.channelPool = make(chan *publishChannel, channelPoolSize)
+	qp.confirmTimeout = defaultConfirmTimeout
+	if config.AppConfig.RMQConfirmTimeout > 0 {
+		qp.confirmTimeout = time.Duration(config.AppConfig.RMQConfirmTimeout) * time.Second
+	}
+	qp.maxReconnectDelay = defaultMaxReconnectDelay
+	if config.AppConfig.RMQReconnectMaxDelay > 0 {
+		qp.maxReconnectDelay = time.Duration(config.AppConfig.RMQReconnectMaxDelay) * time.Second
+	}
+	qp.endpoints = BrokerURLs(config.AppConfig)
+	qp.status = BrokerStatus{State: ConnConnecting, Since: time.Now()}
 	return qp
 }
 
@@ -82,163 +185,411 @@ func (q *QueueProvider) SetArgs(args map[string]interface{}) {
 	q.args = args
 }
 
+// PriorityArgs 返回声明优先级队列的参数, 用于 SetArgs
+// 节点声明自己的队列时也应使用相同的 max, 否则高优先级的任务不会被优先投递
+func PriorityArgs(max uint8) map[string]interface{} {
+	return map[string]interface{}{"x-max-priority": int32(max)}
+}
+
+// NodeQueueArgs 返回节点声明自己的任务队列 (以节点名 node 命名, 绑定在默认 exchange 上) 时应使用的参数:
+// x-max-priority 与 manager 的默认队列一致; x-dead-letter-exchange 指向默认 exchange 的死信 exchange,
+// 在队列中过期或被拒绝的任务消息由 broker 转入死信, manager 的死信记录队列据此更新任务状态
+// 节点使用 QueueProvider 并开启 QueueOptions.DeadLetter 时, 死信参数由 queueArgs 自动加入
+func NodeQueueArgs(node string) map[string]interface{} {
+	args := PriorityArgs(MaxTaskPriority)
+	args["x-dead-letter-exchange"] = defaultExchange + ".dlx"
+	args["x-dead-letter-routing-key"] = node
+	return args
+}
+
+// SetHandler 设置带 context 和完整元数据的消息处理函数, 消费过程中设置时后续消息使用新的 handler
+func (q *QueueProvider) SetHandler(handler DeliveryHandler) {
+	q.handlerMu.Lock()
+	defer q.handlerMu.Unlock()
+	q.handler = handler
+}
+
+// currentHandler 返回当前的消息处理函数
+func (q *QueueProvider) currentHandler() DeliveryHandler {
+	q.handlerMu.RLock()
+	defer q.handlerMu.RUnlock()
+	return q.handler
+}
+
 // SetQOS 设置最大接收数量
 func (q *QueueProvider) SetQOS(qos int) {
 	q.qos = qos
 }
 
-// Start 启动一个队列
+// workers 处理消息的 goroutine 数量, 至少为 1
+func (q *QueueProvider) workers() int {
+	if q.options.Workers > 0 {
+		return q.options.Workers
+	}
+	return 1
+}
+
+// prefetch 未确认消息的上限, 默认与 workers 一致,
+// 这样 broker 不会推送超过处理能力的消息, 处理慢时消费也随之变慢
+func (q *QueueProvider) prefetch() int {
+	if q.qos > 0 {
+		return q.qos
+	}
+	return q.workers()
+}
+
+// Start 启动一个队列, 已经启动时直接返回
+// 启动后断线期间调用 Declare/Consume 不会再次连接, 重连后 Run 会声明 topology 并按 handler 开始消费
 func (q *QueueProvider) Start() error {
+	q.startMu.Lock()
+	defer q.startMu.Unlock()
+	if q.started {
+		return nil
+	}
 	if err := q.Run(); err != nil {
 		return err
 	}
+	q.started = true
 	go q.ReConnect()
 	return nil
 }
 
-// Stop 停止一个队列
+// Stop 停止一个队列, 可以重复调用
 func (q *QueueProvider) Stop() {
-	close(q.quit)
-
-	if !q.conn.IsClosed() {
-		if err := q.channel.Cancel(q.tag, true); err != nil {
-			slog.Error("messaging queue - channel cancel failed: " + err.Error())
-		}
-		for channel := range q.channelPool {
-			if err := channel.Cancel(q.tag, true); err != nil {
-				slog.Error("messaging queue - channel cancel failed: " + err.Error())
-			}
+	q.stopOnce.Do(func() {
+		close(q.quit)
+		q.setState(ConnClosed, nil)
+		q.cancelSession()
+		q.drainChannelPool()
+		q.closeCurrent()
+		if n := q.Buffered(); n > 0 {
+			slog.Warn("messaging queue - stopped with unsent buffered messages", "queue", q.queue, "buffered", n)
 		}
-		close(q.channelPool)
-		if err := q.conn.Close(); err != nil {
-			slog.Error("messaging queue - connection close failed: " + err.Error())
-		}
-	}
+	})
 }
 
-func (q *QueueProvider) initConn() (*amqp.Connection, error) {
-	addr := fmt.Sprintf("amqp://%s:%s@%s:%d%s", q.username, q.password, q.addr, q.port, q.vhost)
-	if conn, err := amqp.Dial(addr); err != nil {
-		return nil, err
-	} else {
-		return conn, err
+// initConn 从上一次连接的下一个地址开始依次尝试, 重连时会换到集群中的其他节点
+// 返回隐藏了密码的已连接地址
+func (q *QueueProvider) initConn() (*amqp.Connection, string, error) {
+	if len(q.endpoints) == 0 {
+		return nil, "", fmt.Errorf("messaging queue - no broker address configured")
+	}
+	var err error
+	for i := 0; i < len(q.endpoints); i++ {
+		n := (q.nextEndpoint + i) % len(q.endpoints)
+		endpoint := RedactURL(q.endpoints[n])
+		var conn *amqp.Connection
+		if conn, err = DialBroker(config.AppConfig, q.endpoints[n]); err == nil {
+			q.nextEndpoint = (n + 1) % len(q.endpoints)
+			return conn, endpoint, nil
+		}
+		slog.Warn("messaging queue - dial failed", "endpoint", endpoint, "error", err)
 	}
+	return nil, "", err
 }
 
-func (q *QueueProvider) initChannel() (*amqp.Channel, error) {
+func (q *QueueProvider) initChannel(conn *amqp.Connection) (*amqp.Channel, error) {
 	var (
 		channel *amqp.Channel
 		err     error
 	)
-	if channel, err = q.conn.Channel(); err != nil {
-		q.conn.Close()
+	if channel, err = conn.Channel(); err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	if err := channel.ExchangeDeclare(
+	if channel, err = q.declareTopology(conn, channel); err != nil {
+		if channel != nil {
+			channel.Close()
+		}
+		conn.Close()
+		return nil, err
+	}
+
+	channel.Qos(q.prefetch(), 0, false)
+
+	return channel, nil
+}
+
+// declareTopology 声明 exchange、queue 及其绑定, 开启死信时同时声明死信 exchange 和 queue
+// 声明过程中 channel 可能被 broker 关闭后重开, 返回最终可用的 channel
+func (q *QueueProvider) declareTopology(conn *amqp.Connection, channel *amqp.Channel) (*amqp.Channel, error) {
+	var err error
+
+	if channel, err = q.declareExchange(conn, channel, q.exchange, q.exchangeType, q.autoDelete); err != nil {
+		return channel, err
+	}
+
+	if q.options.DeadLetter {
+		if channel, err = q.declareExchange(conn, channel, q.DeadLetterExchange(), ExchangeTopic, false); err != nil {
+			return channel, err
+		}
+		if channel, err = q.declareQueue(conn, channel, q.DeadLetterQueue(), false, nil); err != nil {
+			return channel, err
+		}
+		if err = channel.QueueBind(q.DeadLetterQueue(), q.queue, q.DeadLetterExchange(), false, nil); err != nil {
+			return channel, err
+		}
+	}
+
+	if q.options.MaxRedelivery > 0 {
+		if channel, err = q.declareQueue(conn, channel, q.QuarantineQueue(), false, nil); err != nil {
+			return channel, err
+		}
+	}
+
+	if channel, err = q.declareQueue(conn, channel, q.queue, q.autoDelete, q.queueArgs()); err != nil {
+		return channel, err
+	}
+
+	return channel, channel.QueueBind(
+		q.queue,
+		q.routingKey,
 		q.exchange,
-		q.exchangeType,
-		false, //durable
-		q.autoDelete,
+		false,
+		nil,
+	)
+}
+
+// queueArgs 返回声明队列时的参数, 在 SetArgs 设置的参数上加入死信配置
+func (q *QueueProvider) queueArgs() amqp.Table {
+	if !q.options.DeadLetter {
+		return q.args
+	}
+	args := amqp.Table{}
+	for k, v := range q.args {
+		args[k] = v
+	}
+	args["x-dead-letter-exchange"] = q.DeadLetterExchange()
+	args["x-dead-letter-routing-key"] = q.queue
+	return args
+}
+
+// declareExchange 声明 exchange
+// 如果 exchange 已以不同的参数存在(例如旧的非持久化 exchange), broker 会关闭 channel,
+// 此时换一个新 channel 沿用已有的 exchange, 不影响其他绑定
+func (q *QueueProvider) declareExchange(conn *amqp.Connection, channel *amqp.Channel, name, kind string, autoDelete bool) (*amqp.Channel, error) {
+	err := channel.ExchangeDeclare(
+		name,
+		kind,
+		q.options.Durable,
+		autoDelete,
 		false,
 		false,
 		nil,
-	); err != nil {
-		channel.Close()
-		q.conn.Close()
-		return nil, err
+	)
+	if !isPreconditionFailed(err) {
+		return channel, err
 	}
 
-	channel.Qos(q.qos, 0, false)
+	slog.Warn("messaging queue - exchange exists with different arguments, using it as is",
+		"exchange", name, "durable", q.options.Durable, "error", err)
+	if channel, err = conn.Channel(); err != nil {
+		return nil, err
+	}
+	return channel, channel.ExchangeDeclarePassive(name, kind, q.options.Durable, autoDelete, false, false, nil)
+}
 
-	if _, err = channel.QueueDeclare(
-		q.queue,
-		false,        //durable
-		q.autoDelete, //delete when ack
+// declareQueue 声明 queue
+// 如果 queue 已以不同的参数存在: 空闲且没有消息时删除后重新声明;
+// 否则沿用已有的 queue 并给出警告, 等消息消费完后再迁移
+func (q *QueueProvider) declareQueue(conn *amqp.Connection, channel *amqp.Channel, name string, autoDelete bool, args amqp.Table) (*amqp.Channel, error) {
+	_, err := channel.QueueDeclare(
+		name,
+		q.options.Durable,
+		autoDelete, //delete when ack
 		false,
 		false,
-		q.args,
-	); err != nil {
-		channel.Close()
-		q.conn.Close()
+		args,
+	)
+	if !isPreconditionFailed(err) {
+		return channel, err
+	}
+
+	if channel, err = conn.Channel(); err != nil {
 		return nil, err
 	}
+	existing, err := channel.QueueDeclarePassive(name, q.options.Durable, autoDelete, false, false, nil)
+	if err != nil {
+		return channel, err
+	}
 
-	if err = channel.QueueBind(
-		q.queue,
-		q.routingKey,
-		q.exchange,
-		false,
-		nil,
-	); err != nil {
+	if existing.Messages == 0 && existing.Consumers == 0 {
+		slog.Info("messaging queue - redeclaring empty queue with new arguments", "queue", name, "durable", q.options.Durable)
+		if _, err = channel.QueueDelete(name, true, true, false); err == nil {
+			_, err = channel.QueueDeclare(name, q.options.Durable, autoDelete, false, false, args)
+			return channel, err
+		}
+		// 删除期间有新消息或消费者, channel 已被关闭
+		if channel, err = conn.Channel(); err != nil {
+			return nil, err
+		}
+	}
+
+	slog.Warn("messaging queue - queue exists with different arguments, using it as is until it is drained",
+		"queue", name, "messages", existing.Messages, "consumers", existing.Consumers, "durable", q.options.Durable)
+	return channel, nil
+}
+
+// isPreconditionFailed 声明的参数与 broker 上已有的不一致
+func isPreconditionFailed(err error) bool {
+	var amqpErr *amqp.Error
+	return errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed
+}
+
+// publishing 构造一条待发布的消息
+func (q *QueueProvider) publishing(m Message) amqp.Publishing {
+	m = compressMessage(q.options, m)
+	p := amqp.Publishing{
+		Headers:         m.Headers,
+		ContentType:     m.ContentType,
+		ContentEncoding: m.ContentEncoding,
+		MessageId:       m.MessageID,
+		CorrelationId:   m.CorrelationID,
+		Type:            m.Type,
+		Priority:        m.Priority,
+		Timestamp:       m.Timestamp,
+		Body:            m.Body,
+	}
+	if m.Expiration > 0 {
+		p.Expiration = strconv.FormatInt(m.Expiration.Milliseconds(), 10)
+	}
+	if q.options.Persistent {
+		p.DeliveryMode = amqp.Persistent
+	}
+	return p
+}
+
+// initPublishChannel 打开一个 confirm 模式的 channel 用于发布
+func (q *QueueProvider) initPublishChannel() (*publishChannel, error) {
+	conn := q.currentConn()
+	if conn == nil || conn.IsClosed() {
+		return nil, ErrNotConnected
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if err := channel.Confirm(false); err != nil {
 		channel.Close()
-		q.conn.Close()
 		return nil, err
 	}
-	return channel, nil
+	return &publishChannel{
+		channel:  channel,
+		confirms: channel.NotifyPublish(make(chan amqp.Confirmation, 1)),
+		returns:  channel.NotifyReturn(make(chan amqp.Return, 1)),
+	}, nil
 }
 
-// initChannel initializes a new AMQP channel from the pool
-func (q *QueueProvider) getChannel() (*amqp.Channel, error) {
+// getChannel 从池中取一个发布 channel, 池为空时新建
+func (q *QueueProvider) getChannel() (*publishChannel, error) {
 	select {
-	// case channel := <-q.channelPool:
-	// 	// Reuse existing channel from the pool
-	// 	return channel, nil
+	case pc := <-q.channelPool:
+		return pc, nil
 	default:
-		// Create a new channel if the pool is empty
-		return q.initChannel()
+		return q.initPublishChannel()
 	}
 }
 
 // releaseChannel releases an AMQP channel back to the pool
-func (q *QueueProvider) releaseChannel(channel *amqp.Channel) {
+func (q *QueueProvider) releaseChannel(pc *publishChannel) {
 	select {
-	case q.channelPool <- channel:
+	case q.channelPool <- pc:
 		// Return the channel to the pool
 	default:
 		// Pool is full, close the channel
-		channel.Close()
+		pc.channel.Close()
 	}
 }
 
-// Run 运行队列
-func (q *QueueProvider) Run() error {
-	var err error
+// drainChannelPool 关闭池中所有的发布 channel
+func (q *QueueProvider) drainChannelPool() {
+	for {
+		select {
+		case pc := <-q.channelPool:
+			pc.channel.Close()
+		default:
+			return
+		}
+	}
+}
 
-	if q.conn, err = q.initConn(); err != nil {
+// Run 运行队列: 建立连接、声明 topology, 有 handler 时开始消费
+// 新的连接准备好之后才替换旧的, 发布方不会看到初始化到一半的连接
+func (q *QueueProvider) Run() error {
+	conn, endpoint, err := q.initConn()
+	if err != nil {
+		q.setLastError(err)
 		return err
 	}
 
-	if q.channel, err = q.initChannel(); err != nil {
+	channel, err := q.initChannel(conn)
+	if err != nil {
+		q.setLastError(err)
 		return err
 	}
 
-	if q.handler != nil {
-		var delivery <-chan amqp.Delivery
-		if delivery, err = q.channel.Consume(
-			q.queue,
-			q.tag,
-			false, //auto-act
-			false, // exclusive
-			false, // no-local
-			false, // no-wait
-			nil,   //args
-		); err != nil {
-			q.channel.Close()
-			q.conn.Close()
+	// 旧连接上的发布 channel 已失效
+	q.drainChannelPool()
+
+	q.mu.Lock()
+	q.conn = conn
+	q.channel = channel
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	q.connNotify = conn.NotifyClose(make(chan *amqp.Error, 1))
+	q.channelNotify = channel.NotifyClose(make(chan *amqp.Error, 1))
+	q.mu.Unlock()
+	go q.logReturns(channel.NotifyReturn(make(chan amqp.Return, 1)))
+
+	if q.consumes() {
+		if err = q.consume(); err != nil {
+			q.setLastError(err)
+			channel.Close()
+			conn.Close()
 			return err
 		}
+	}
 
-		go q.Handle(delivery)
+	q.setEndpoint(endpoint)
+	q.setState(ConnConnected, nil)
+	slog.Info("messaging queue - connected", "queue", q.queue, "endpoint", endpoint)
+	go q.flushBuffer()
+	return nil
+}
+
+// logReturns 记录不等待确认的发布中被 broker 退回的消息, channel 关闭时退出
+func (q *QueueProvider) logReturns(returns chan amqp.Return) {
+	for r := range returns {
+		slog.Error("messaging queue - message returned unroutable",
+			"exchange", r.Exchange, "route", r.RoutingKey, "message_id", r.MessageId, "reason", r.ReplyText)
 	}
+}
 
-	q.connNotify = q.conn.NotifyClose(make(chan *amqp.Error))
-	q.channelNotify = q.channel.NotifyClose(make(chan *amqp.Error))
+// consume 在当前 channel 上开始消费
+func (q *QueueProvider) consume() error {
+	q.mu.RLock()
+	channel, ctx := q.channel, q.ctx
+	q.mu.RUnlock()
 
-	return err
+	delivery, err := channel.Consume(
+		q.queue,
+		q.tag,
+		false, //auto-act
+		false, // exclusive
+		false, // no-local
+		false, // no-wait
+		nil,   //args
+	)
+	if err != nil {
+		return err
+	}
+
+	go q.handle(ctx, delivery)
+	return nil
 }
 
 // ReConnect 重新连接队列
+// 连接或 channel 断开后按指数退避(带随机抖动)重试, 直到成功或 Stop
 func (q *QueueProvider) ReConnect() {
 	defer func() {
 		if err := recover(); err != nil {
@@ -246,13 +597,20 @@ func (q *QueueProvider) ReConnect() {
 		}
 	}()
 	for {
+		q.mu.RLock()
+		connNotify, channelNotify := q.connNotify, q.channelNotify
+		q.mu.RUnlock()
+
+		var reason error
 		select {
-		case err := <-q.connNotify:
+		case err := <-connNotify:
 			if err != nil {
+				reason = err
 				slog.Error("messaging queue - conn notifyclose:" + err.Error())
 			}
-		case err := <-q.channelNotify:
+		case err := <-channelNotify:
 			if err != nil {
+				reason = err
 				slog.Error("messaging queue - channel notifyclose: " + err.Error())
 			}
 
@@ -260,97 +618,190 @@ func (q *QueueProvider) ReConnect() {
 			return
 		}
 
-		// backstop
-		if !q.conn.IsClosed() {
-			if err := q.channel.Cancel(q.tag, true); err != nil {
-				slog.Error("messaging queue - channel cancel failed: " + err.Error())
-			}
-
-			if err := q.conn.Close(); err != nil {
-				slog.Error("messaging queue - connection cancel failed: " + err.Error())
-			}
-		}
+		q.setState(ConnReconnecting, reason)
 
-		for err := range q.channelNotify {
-			slog.Error(err.Error())
-		}
+		// 通知正在处理的消息放弃, 连接断开后它们已无法 ack
+		q.cancelSession()
 
-		for err := range q.connNotify {
-			slog.Error(err.Error())
-		}
+		// backstop
+		q.closeCurrent()
 
-	quit:
+		for attempt := 0; ; attempt++ {
+			slog.Info("messaging queue - reconnect", "queue", q.queue, "attempt", attempt+1)
+			err := q.Run()
+			if err == nil {
+				break
+			}
 
-		for {
+			delay := reconnectDelay(attempt, q.maxReconnectDelay)
+			slog.Error("messaging queue - failCheck: "+err.Error(), "retry_in", delay)
 			select {
 			case <-q.quit:
 				return
-			default:
-				slog.Info("messaging queue - reconnect")
-
-				if err := q.Run(); err != nil {
-					slog.Error("messaging queue - failCheck: " + err.Error())
-					time.Sleep(time.Second * 5)
-					continue
-				}
-				break quit
+			case <-time.After(delay):
 			}
 		}
 	}
 }
 
-// Handle 消息处理
+// HandleBatch 消息处理, 与 Handle 相同
 func (q *QueueProvider) HandleBatch(delivery <-chan amqp.Delivery) {
-	if q.handler == nil {
+	q.Handle(delivery)
+}
+
+// Handle 消息处理
+// 固定数量的 worker 从 delivery 中取消息, 同时处理的消息数不会超过 workers
+func (q *QueueProvider) Handle(delivery <-chan amqp.Delivery) {
+	q.mu.RLock()
+	ctx := q.ctx
+	q.mu.RUnlock()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	q.handle(ctx, delivery)
+}
+
+func (q *QueueProvider) handle(ctx context.Context, delivery <-chan amqp.Delivery) {
+	if !q.consumes() {
 		return
 	}
 
-	for d := range delivery {
-		go func(delivery amqp.Delivery) {
-			if err := q.handler(delivery.Body); err == nil {
-				delivery.Ack(false)
-			} else {
-				delivery.Reject(true)
+	var wg sync.WaitGroup
+	for i := 0; i < q.workers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range delivery {
+				q.handleDelivery(ctx, d)
 			}
-		}(d)
+		}()
 	}
+	wg.Wait()
 }
 
-// Handle 消息处理
-func (q *QueueProvider) Handle(delivery <-chan amqp.Delivery) {
-	if q.handler == nil {
-		return
+func (q *QueueProvider) consumes() bool {
+	return q.currentHandler() != nil
+}
+
+// cancelSession 取消当前连接上正在处理的消息
+func (q *QueueProvider) cancelSession() {
+	q.mu.RLock()
+	cancel := q.cancel
+	q.mu.RUnlock()
+	if cancel != nil {
+		cancel()
 	}
-	for d := range delivery {
-		go func(delivery amqp.Delivery) {
-			if err := q.handler(delivery.Body); err == nil {
-				delivery.Ack(false)
-			} else {
-				delivery.Reject(true)
+}
+
+// handleDelivery 处理一条消息, 成功 ack, 失败交给 handleFailure
+// 压缩的消息先解压, 解压失败时不重试, 由 decideFailure 隔离或丢弃;
+// 设置了 MaxRedelivery 时, broker 重新投递的消息先计数: 超过时隔离, 否则带上次数重新发布到本队列后再处理
+func (q *QueueProvider) handleDelivery(ctx context.Context, delivery amqp.Delivery) {
+	d, err := decompressDelivery(newDelivery(delivery))
+	if err == nil && q.options.MaxRedelivery > 0 {
+		if redelivered := redeliveredCount(d); redelivered > 0 {
+			headers, exceeded := countRedeliveries(q.options, d, redelivered)
+			action := failureRetry
+			if exceeded {
+				action = failureQuarantine
 			}
-		}(d)
+			q.resolveFailure(delivery, d, action, headers, ErrRedelivered)
+			return
+		}
+	}
+	if err == nil {
+		err = callHandler(ctx, q.options, q.currentHandler(), d)
+	}
+	if err == nil {
+		delivery.Ack(false)
+		return
+	}
+	if ctx.Err() != nil {
+		// 因 Stop 或断线被中断, 不计入重试次数; 设置了 MaxRedelivery 时重新投递后计入投递次数
+		delivery.Reject(true)
+		return
 	}
+	q.handleFailure(ctx, delivery, d, err)
 }
 
-// PublishTo 发布到某个路由的Q里
+// handleFailure 处理失败的消息, 去向由 decideFailure 决定:
+// 重试时通过默认 exchange 直接投递回本队列, 避免 fanout/topic 重复路由到其他队列;
+// 死信时连同最后的错误一起转入死信 exchange; 隔离时通过默认 exchange 转入隔离队列;
+// 正在被其他消费者处理的消息占用 worker 等待 deferDelay 后原样投递回本队列
+// d 是解压后的消息, 重新发布时按 QueueOptions 再次压缩
+func (q *QueueProvider) handleFailure(ctx context.Context, delivery amqp.Delivery, d Delivery, handlerErr error) {
+	action, headers := decideFailure(q.options, d, handlerErr)
+	if action == failureDefer {
+		select {
+		case <-ctx.Done():
+			delivery.Reject(true)
+			return
+		case <-time.After(deferDelay):
+		}
+	}
+	q.resolveFailure(delivery, d, action, headers, handlerErr)
+}
+
+// resolveFailure 按 action 处理消息, headers 是重新发布时使用的 headers
+func (q *QueueProvider) resolveFailure(delivery amqp.Delivery, d Delivery, action failureAction, headers map[string]interface{}, handlerErr error) {
+	if action == failureRequeue {
+		delivery.Reject(true)
+		return
+	}
+	if action == failureDrop {
+		// 设置了 x-dead-letter-exchange 的队列 (例如节点队列) 由 broker 转入死信
+		slog.Error("messaging queue - message dropped", "queue", q.queue, "message_id", d.MessageID, "error", handlerErr)
+		delivery.Reject(false)
+		return
+	}
+
+	m := d.Message()
+	m.Headers = headers
+
+	// 新消息经 broker 确认后才 ack 原消息, 否则两者可能同时丢失
+	if action == failureRetry || action == failureDefer {
+		if deadline := headerDeadline(d.Headers); deadline > 0 {
+			m.Expiration = expirationUntil(deadline)
+		}
+		if err := q.publishConfirmed(context.Background(), "", q.queue, m); err != nil {
+			slog.Error("messaging queue - retry publish failed", "queue", q.queue, "error", err)
+			delivery.Reject(true)
+			return
+		}
+		delivery.Ack(false)
+		return
+	}
+
+	if action == failureQuarantine {
+		if err := q.publishConfirmed(context.Background(), "", q.QuarantineQueue(), m); err != nil {
+			slog.Error("messaging queue - quarantine publish failed", "queue", q.queue, "error", err)
+			delivery.Reject(true)
+			return
+		}
+		slog.Warn("messaging queue - message quarantined", "queue", q.queue, "delivered", headers[HeaderDeliveryCount], "error", handlerErr)
+		delivery.Ack(false)
+		return
+	}
+
+	if err := q.publishConfirmed(context.Background(), q.DeadLetterExchange(), q.queue, m); err != nil {
+		// 由队列的 x-dead-letter-exchange 兜底, 只是丢失了错误信息
+		slog.Error("messaging queue - dead letter publish failed", "queue", q.queue, "error", err)
+		delivery.Reject(false)
+		return
+	}
+	slog.Warn("messaging queue - message dead-lettered", "queue", q.queue, "attempt", headers[HeaderAttempt], "error", handlerErr)
+	delivery.Ack(false)
+}
+
+// PublishTo 发布到某个路由的Q里, 断线时放入发布缓存
 func (q *QueueProvider) PublishTo(route string, msg []byte) error {
 	//fmt.Printf("Publish to %s n \n ", route)
-	if q == nil || q.channel == nil {
+	if q == nil {
 		err := fmt.Errorf("no channel valid %s", route)
 		slog.Error(string(msg), "error", err)
 		return err
 	}
-
-	return q.channel.Publish(
-		q.exchange,
-		route,
-		false,
-		false,
-		amqp.Publishing{
-			//ContentType: "application/json",
-			Body: msg,
-		},
-	)
+	return q.publishOrBuffer(q.exchange, route, Message{Body: msg})
 }
 
 // Publish 发布一条消息
@@ -358,40 +809,86 @@ func (q *QueueProvider) Publish(msg []byte) error {
 	return q.PublishTo(q.routingKey, msg)
 }
 
-// SafePublish 发送时独占channel 且会重试
-func (q *QueueProvider) SafePublish(msg []byte) error {
-	var err error
-	for i := 0; i < len(q.channelPool)+1; i++ {
-		err = q.quickPublish(msg)
-		if err == nil {
-			break
-		}
-	}
-	if err != nil {
-		slog.Error("QuickPublish", "error", err)
-		return err
+// PublishWithConfirm 发布到某个路由的Q里, 并等待 broker 确认
+func (q *QueueProvider) PublishWithConfirm(ctx context.Context, route string, msg []byte) error {
+	return q.PublishMessage(ctx, route, Message{Body: msg})
+}
+
+// PublishMessage 带消息属性发布到某个路由的Q里, 并等待 broker 确认
+// 只有在收到 basic.ack 后才返回 nil; nack、超时或 ctx 取消都会返回错误
+func (q *QueueProvider) PublishMessage(ctx context.Context, route string, m Message) error {
+	if q == nil {
+		return fmt.Errorf("no channel valid %s", route)
 	}
-	return nil
+	return q.publishConfirmed(ctx, q.exchange, route, m)
 }
 
-func (q *QueueProvider) quickPublish(msg []byte) error {
-	channel, err := q.getChannel()
+// publishConfirmed 发布到任意 exchange 并等待确认
+func (q *QueueProvider) publishConfirmed(ctx context.Context, exchange, route string, m Message) error {
+	if q.State() != ConnConnected {
+		return ErrNotConnected
+	}
+	pc, err := q.getChannel()
 	if err != nil {
-		slog.Error("QuickPublish getChannel", "error", err)
 		return err
 	}
-	defer q.releaseChannel(channel)
-	err = channel.Publish(
-		q.exchange,
-		q.routingKey,
-		false,
+
+	if err := pc.channel.Publish(
+		exchange,
+		route,
+		true,
 		false,
-		amqp.Publishing{
-			//ContentType: "application/json",
-			Body: msg,
-		},
-	)
+		q.publishing(m),
+	); err != nil {
+		pc.channel.Close()
+		return err
+	}
+
+	timer := time.NewTimer(q.confirmTimeout)
+	defer timer.Stop()
+
+	// channel 是独占的, 收到的下一个确认即为本条消息的确认
+	// 超时或取消后确认可能迟到, 该 channel 不能再放回池中
+	select {
+	case confirm, ok := <-pc.confirms:
+		if !ok {
+			return ErrChannelClosed
+		}
+		// basic.return 在确认之前到达, 此时已经在 returns 中
+		var returned *amqp.Return
+		select {
+		case r := <-pc.returns:
+			returned = &r
+		default:
+		}
+		q.releaseChannel(pc)
+		if !confirm.Ack {
+			return fmt.Errorf("%w: route %s", ErrPublishNacked, route)
+		}
+		if returned != nil {
+			return fmt.Errorf("%w: exchange %s route %s: %s", ErrUnroutable, exchange, route, returned.ReplyText)
+		}
+		return nil
+	case <-timer.C:
+		pc.channel.Close()
+		return ErrConfirmTimeout
+	case <-ctx.Done():
+		pc.channel.Close()
+		return ctx.Err()
+	}
+}
+
+// SafePublish 发送时独占channel, 等待确认且会重试
+func (q *QueueProvider) SafePublish(msg []byte) error {
+	var err error
+	for i := 0; i < cap(q.channelPool)+1; i++ {
+		err = q.PublishWithConfirm(context.Background(), q.routingKey, msg)
+		if err == nil {
+			break
+		}
+	}
 	if err != nil {
+		slog.Error("SafePublish", "error", err)
 		return err
 	}
 	return nil
@@ -402,31 +899,95 @@ func (q *QueueProvider) quickPublish(msg []byte) error {
 // 复用作为consumer的agent queue
 // producer则无需声明自己的queue
 func (q *QueueProvider) PublishToExchange(exchange, route string, msg []byte) error {
-	return q.channel.Publish(
-		exchange,
-		route,
-		false,
-		false,
-		amqp.Publishing{
-			//ContentType: "application/json",
-			Body: msg,
-		},
-	)
+	return q.publishOrBuffer(exchange, route, Message{Body: msg})
+}
+
+// PublishMessageToExchange 带消息属性发布到其他 exchange, 并等待 broker 确认
+func (q *QueueProvider) PublishMessageToExchange(ctx context.Context, exchange, route string, m Message) error {
+	if q == nil {
+		return fmt.Errorf("no channel valid %s", exchange)
+	}
+	return q.publishConfirmed(ctx, exchange, route, m)
+}
+
+// Declare 声明 exchange、queue 及其绑定, 未连接时先连接
+func (q *QueueProvider) Declare() error {
+	conn := q.currentConn()
+	if conn == nil || conn.IsClosed() {
+		return q.Start()
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	channel, err = q.declareTopology(conn, channel)
+	if channel != nil {
+		channel.Close()
+	}
+	return err
+}
+
+// Consume 使用 handler 开始消费队列, 未连接时先连接
+func (q *QueueProvider) Consume(handler DeliveryHandler) error {
+	q.handlerMu.Lock()
+	consuming := q.handler != nil
+	q.handler = handler
+	q.handlerMu.Unlock()
+	if conn := q.currentConn(); conn == nil || conn.IsClosed() {
+		return q.Start()
+	}
+	if consuming {
+		// 已经在消费, 后续消息使用新的 handler
+		return nil
+	}
+	return q.consume()
+}
+
+// Close 停止队列
+func (q *QueueProvider) Close() error {
+	q.Stop()
+	return nil
 }
 
 func (q *QueueProvider) Queue() string {
 	return q.queue
 }
 
+// DeadLetterExchange 死信 exchange 名称, 同一个 exchange 下的队列共用
+func (q *QueueProvider) DeadLetterExchange() string {
+	return q.exchange + ".dlx"
+}
+
+// DeadLetterQueue 死信队列名称
+func (q *QueueProvider) DeadLetterQueue() string {
+	return q.queue + ".dlq"
+}
+
+// QuarantineQueue 超过 MaxRedelivery 的消息所在的隔离队列
+func (q *QueueProvider) QuarantineQueue() string {
+	return q.queue + ".quarantine"
+}
+
 func defaultHandler(msg []byte) error {
 	fmt.Println(string(msg))
 	return nil
 }
 
-// DefaultQueueProvider 默认队列
+// defaultExchange 分发任务使用的 exchange
+const defaultExchange = "onedotnet.asynctask"
+
+// DefaultQueueProvider 默认队列, 由 StartDefaultQueueProvider 创建
 var DefaultQueueProvider *QueueProvider
 
-func init() {
-	DefaultQueueProvider = NewQueueProvider("onedotnet.asynctask", ExchangeDirect, "default", "default", false, defaultHandler)
-	DefaultQueueProvider.Start()
+// StartDefaultQueueProvider 连接 RabbitMQ, 启动默认队列并设置为 DefaultBroker
+func StartDefaultQueueProvider() (*QueueProvider, error) {
+	qp := NewQueueProvider(defaultExchange, ExchangeDirect, "default", "default", false, nil)
+	qp.SetHandler(Idempotent(qp.Queue(), IdempotencyTTL(), AdaptHandler(defaultHandler)))
+	qp.SetArgs(PriorityArgs(MaxTaskPriority))
+	if err := qp.Start(); err != nil {
+		return nil, err
+	}
+	DefaultQueueProvider = qp
+	DefaultBroker = qp
+	return qp, nil
 }
@@ -1,6 +1,8 @@
 package taskmanager
 
 import (
+	"log/slog"
+
 	"github.com/jasonlvhit/gocron"
 	"github.com/onedotnet/asynctasks/database"
 )
@@ -13,6 +15,14 @@ func Every10MinutesTask() {
 }
 
 func StartBackGroundServices() {
+	if err := StartDeadLetterRecorder(); err != nil {
+		slog.Error("start dead letter recorder failed", "error", err)
+	}
 	gocron.Every(10).Minutes().Do(Every10MinutesTask)
+	gocron.Every(5).Seconds().Do(DispatchDelayedTasks)
+	gocron.Every(2).Seconds().Do(RelayOutbox)
+	gocron.Every(10).Seconds().Do(ExpireTasks)
+	gocron.Every(10).Seconds().Do(ResendCancellations)
+	gocron.Every(1).Hour().Do(PurgeProcessedMessages)
 	gocron.Start()
 }
@@ -0,0 +1,218 @@
+package taskmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"time"
+
+	"github.com/onedotnet/asynctasks/config"
+)
+
+// Broker 消息队列的抽象, 分发和消息处理的逻辑只依赖它
+// QueueProvider 是 RabbitMQ 的实现, PostgresBroker 使用 PostgreSQL 表, MemoryBroker 是进程内的实现
+type Broker interface {
+	// Declare 声明 exchange、queue 及其绑定
+	Declare() error
+	// Publish 发布到默认路由
+	Publish(msg []byte) error
+	// PublishTo 发布到 exchange 上的某个路由
+	PublishTo(route string, msg []byte) error
+	// PublishWithConfirm 发布并等待 broker 确认
+	PublishWithConfirm(ctx context.Context, route string, msg []byte) error
+	// PublishMessage 带消息属性发布并等待 broker 确认, 没有路由到任何队列时返回 ErrUnroutable
+	PublishMessage(ctx context.Context, route string, m Message) error
+	// PublishToExchange 发布到其他 exchange
+	PublishToExchange(exchange, route string, msg []byte) error
+	// PublishMessageToExchange 带消息属性发布到其他 exchange 并等待确认, 没有路由到任何队列时返回 ErrUnroutable
+	PublishMessageToExchange(ctx context.Context, exchange, route string, m Message) error
+	// Consume 使用 handler 开始消费队列
+	Consume(handler DeliveryHandler) error
+	// Close 停止消费并释放连接
+	Close() error
+	// Status 返回连接状态
+	Status() BrokerStatus
+}
+
+// DefaultBroker 分发任务使用的 Broker
+var DefaultBroker Broker
+
+var (
+	_ Broker = (*QueueProvider)(nil)
+	_ Broker = (*PostgresBroker)(nil)
+	_ Broker = (*MemoryBroker)(nil)
+)
+
+// QUEUE_BACKEND 可选的队列后端
+const (
+	BackendRabbitMQ = "rabbitmq"
+	BackendPostgres = "postgres"
+)
+
+// NewBroker 按 QUEUE_BACKEND 创建一个还没有连接的 Broker
+func NewBroker(exchange, exchangeKind, route, queue string, opts QueueOptions) (Broker, error) {
+	switch config.AppConfig.QueueBackend {
+	case "", BackendRabbitMQ:
+		return NewQueueProvider(exchange, exchangeKind, route, queue, false, nil, opts), nil
+	case BackendPostgres:
+		return NewPostgresBroker(exchange, exchangeKind, route, queue, opts), nil
+	}
+	return nil, fmt.Errorf("unknown queue backend %q", config.AppConfig.QueueBackend)
+}
+
+// NewDefaultBroker 按 QUEUE_BACKEND 返回默认队列, 不连接也不声明, 用于读取队列名称等
+func NewDefaultBroker() (Broker, error) {
+	return NewBroker(defaultExchange, ExchangeDirect, "default", "default", DefaultQueueOptions())
+}
+
+// StartDefaultBroker 按 QUEUE_BACKEND 启动默认队列并设置为 DefaultBroker
+func StartDefaultBroker() (Broker, error) {
+	if config.AppConfig.QueueBackend != BackendPostgres {
+		qp, err := StartDefaultQueueProvider()
+		if err != nil {
+			return nil, err
+		}
+		return qp, nil
+	}
+
+	broker := NewPostgresBroker(defaultExchange, ExchangeDirect, "default", "default")
+	if err := broker.Consume(Idempotent(broker.Queue(), IdempotencyTTL(), AdaptHandler(defaultHandler))); err != nil {
+		return nil, err
+	}
+	DefaultBroker = broker
+	return broker, nil
+}
+
+// failureAction 消息处理失败后的处理方式
+type failureAction int
+
+const (
+	// failureRequeue 原样放回队列
+	failureRequeue failureAction = iota
+	// failureRetry 带上投递次数重新投递到本队列
+	failureRetry
+	// failureDeadLetter 转入死信 exchange
+	failureDeadLetter
+	// failureQuarantine 超过 MaxRedelivery, 转入隔离队列
+	failureQuarantine
+	// failureDrop 无法处理又没有隔离队列, 丢弃
+	failureDrop
+	// failureDefer 消息正在被其他消费者处理, 等待 deferDelay 后原样重新投递, 不计入重试和投递次数
+	failureDefer
+)
+
+// deferDelay 正在被其他消费者处理的消息重新投递前等待的时间
+var deferDelay = 5 * time.Second
+
+// decideFailure 决定失败消息的去向, 并返回重新投递时使用的 headers
+// 消息体为 Task 时不在 broker 上重试, 直接转入死信, 由 manager 的死信记录队列交给 failTx 按 Task.Retried 重试;
+// 其他消息按 QueueOptions.MaxRedelivery 计数, 超过后转入隔离队列, 未设置时保持 requeue;
+// 无法解压的消息不重试, 直接转入隔离队列, 未设置 MaxRedelivery 时没有隔离队列, 丢弃;
+// 正在被其他消费者处理的重复消息 (ErrMessageInProgress) 稍后原样重新投递, 长时间运行的任务不会因此被转入死信
+func decideFailure(opts QueueOptions, d Delivery, handlerErr error) (failureAction, map[string]interface{}) {
+	if errors.Is(handlerErr, ErrMessageInProgress) {
+		headers := map[string]interface{}{}
+		for k, v := range d.Headers {
+			headers[k] = v
+		}
+		return failureDefer, headers
+	}
+	if errors.Is(handlerErr, ErrUndecodable) {
+		if opts.MaxRedelivery <= 0 {
+			return failureDrop, nil
+		}
+		return failureQuarantine, failureHeaders(d, handlerErr)
+	}
+
+	if opts.DeadLetter && isTaskBody(d.Body) {
+		return failureDeadLetter, failureHeaders(d, handlerErr)
+	}
+
+	if opts.MaxRedelivery <= 0 {
+		return failureRequeue, nil
+	}
+	delivered := headerInt(d.Headers, HeaderDeliveryCount) + 1
+	headers := failureHeaders(d, handlerErr)
+	headers[HeaderDeliveryCount] = int32(delivered)
+	if delivered <= opts.MaxRedelivery {
+		bumpAttempt(headers, d, 1)
+		return failureRetry, headers
+	}
+	return failureQuarantine, headers
+}
+
+// failureHeaders 复制消息的 headers 并记录最后的错误
+// 重新投递经默认 exchange, 只在第一次失败时记录原始路由
+func failureHeaders(d Delivery, handlerErr error) map[string]interface{} {
+	headers := map[string]interface{}{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[HeaderLastError] = handlerErr.Error()
+	if _, ok := headers[HeaderOriginalExchange]; !ok {
+		headers[HeaderOriginalExchange] = d.Exchange
+		headers[HeaderOriginalRoutingKey] = d.RoutingKey
+	}
+	return headers
+}
+
+// brokerDeliveryCount quorum 队列上由 broker 维护的重新投递次数
+const brokerDeliveryCount = "x-delivery-count"
+
+var (
+	// ErrHandlerPanic handler panic, 按处理失败对待
+	ErrHandlerPanic = errors.New("broker - handler panicked")
+	// ErrRedelivered 消息被 broker 直接重新投递 (消费者崩溃、断线或 requeue)
+	ErrRedelivered = errors.New("broker - message redelivered after an interrupted delivery")
+)
+
+// callHandler 按队列选项包装 handler 并处理一条消息, handler panic 时返回 ErrHandlerPanic
+func callHandler(ctx context.Context, opts QueueOptions, handler DeliveryHandler, d Delivery) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("broker - handler panicked", "message_id", d.MessageID, "panic", r, "stack", string(debug.Stack()))
+			err = fmt.Errorf("%w: %v", ErrHandlerPanic, r)
+		}
+	}()
+	return consumeHandler(opts, handler)(ctx, d)
+}
+
+// countRedeliveries 把 broker 直接重新投递的 redelivered 次数计入 HeaderDeliveryCount,
+// 返回新的 headers 和投递次数是否已经超过 MaxRedelivery
+// 处理失败时 decideFailure 计数; 消费者崩溃、断线或 requeue 后 broker 重新投递的消息在这里计数,
+// 否则每次都让消费者崩溃的消息永远不会被隔离
+func countRedeliveries(opts QueueOptions, d Delivery, redelivered int) (map[string]interface{}, bool) {
+	headers := map[string]interface{}{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	// 重新发布后是一条新消息, broker 的计数从零开始
+	delete(headers, brokerDeliveryCount)
+	delivered := headerInt(d.Headers, HeaderDeliveryCount) + redelivered
+	headers[HeaderDeliveryCount] = int32(delivered)
+	bumpAttempt(headers, d, redelivered)
+	return headers, delivered > opts.MaxRedelivery
+}
+
+// bumpAttempt 消息再次交给 handler 之前把 x-attempt 加 n, 没有 x-attempt 的旧消息从第 1 次算起
+func bumpAttempt(headers map[string]interface{}, d Delivery, n int) {
+	attempt := headerInt(d.Headers, HeaderAttempt)
+	if attempt < 1 {
+		attempt = 1
+	}
+	headers[HeaderAttempt] = int32(attempt + n)
+}
+
+// redeliveredCount broker 直接重新投递的次数: quorum 队列使用 x-delivery-count,
+// classic 队列只知道是否重新投递过, 调用方重新发布消息来累计次数
+func redeliveredCount(d Delivery) int {
+	if n := headerInt(d.Headers, brokerDeliveryCount); n > 0 {
+		return n
+	}
+	if d.Redelivered {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,185 @@
+package taskmanager
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+const testTaskBody = `{"message_id":"7f1d2a4e-8a61-4c4e-9f59-2f6a3c1b0d55","max_retry":2}`
+
+func TestDecideFailure(t *testing.T) {
+	task := []byte(testTaskBody)
+	boom := errors.New("boom")
+	tests := []struct {
+		name    string
+		opts    QueueOptions
+		d       Delivery
+		action  failureAction
+		count   int
+		attempt int
+	}{
+		{"requeue without limits", QueueOptions{}, Delivery{Body: task}, failureRequeue, 0, 0},
+		{"requeue other messages", QueueOptions{DeadLetter: true}, Delivery{Body: []byte("raw")}, failureRequeue, 0, 0},
+		{"task dead-lettered for the manager to retry", QueueOptions{DeadLetter: true, MaxRedelivery: 3},
+			Delivery{Body: task, Headers: map[string]interface{}{HeaderAttempt: int32(2)}}, failureDeadLetter, 0, 2},
+		{"task without dead letter counts deliveries", QueueOptions{MaxRedelivery: 3}, Delivery{Body: task}, failureRetry, 1, 2},
+		{"first delivery retried", QueueOptions{MaxRedelivery: 2}, Delivery{Body: []byte("raw")}, failureRetry, 1, 2},
+		{"delivery count carried", QueueOptions{MaxRedelivery: 2},
+			Delivery{Body: []byte("raw"), Headers: map[string]interface{}{HeaderDeliveryCount: int32(1), HeaderAttempt: int32(2)}}, failureRetry, 2, 3},
+		{"over MaxRedelivery quarantined", QueueOptions{MaxRedelivery: 2},
+			Delivery{Body: []byte("raw"), Headers: map[string]interface{}{HeaderDeliveryCount: int32(2), HeaderAttempt: int32(3)}}, failureQuarantine, 3, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.d.Exchange, tt.d.RoutingKey = "tasks", "video"
+			action, headers := decideFailure(tt.opts, tt.d, boom)
+			if action != tt.action {
+				t.Fatalf("action = %d, want %d", action, tt.action)
+			}
+			if action == failureRequeue {
+				if headers != nil {
+					t.Errorf("headers = %v, want nil", headers)
+				}
+				return
+			}
+			if got := headerInt(headers, HeaderDeliveryCount); got != tt.count {
+				t.Errorf("%s = %d, want %d", HeaderDeliveryCount, got, tt.count)
+			}
+			if got := headerInt(headers, HeaderAttempt); got != tt.attempt {
+				t.Errorf("%s = %d, want %d", HeaderAttempt, got, tt.attempt)
+			}
+			if headers[HeaderLastError] != boom.Error() {
+				t.Errorf("%s = %v, want %q", HeaderLastError, headers[HeaderLastError], boom)
+			}
+			if headers[HeaderOriginalExchange] != "tasks" || headers[HeaderOriginalRoutingKey] != "video" {
+				t.Errorf("original route = %v/%v, want tasks/video", headers[HeaderOriginalExchange], headers[HeaderOriginalRoutingKey])
+			}
+			if _, ok := tt.d.Headers[HeaderLastError]; ok {
+				t.Error("decideFailure modified the delivery headers")
+			}
+		})
+	}
+}
+
+func TestDecideFailureKeepsOriginalRoute(t *testing.T) {
+	// 重试经默认 exchange 投递回本队列, 不能覆盖第一次失败时的路由
+	d := Delivery{
+		Body:       []byte("raw"),
+		Exchange:   "",
+		RoutingKey: "video",
+		Headers: map[string]interface{}{
+			HeaderDeliveryCount:      int32(2),
+			HeaderOriginalExchange:   "tasks",
+			HeaderOriginalRoutingKey: "task.video",
+		},
+	}
+	action, headers := decideFailure(QueueOptions{MaxRedelivery: 5}, d, errors.New("boom"))
+	if action != failureRetry {
+		t.Fatalf("action = %d, want retry", action)
+	}
+	if headers[HeaderOriginalExchange] != "tasks" || headers[HeaderOriginalRoutingKey] != "task.video" {
+		t.Errorf("original route = %v/%v, want tasks/task.video", headers[HeaderOriginalExchange], headers[HeaderOriginalRoutingKey])
+	}
+}
+
+func TestRedeliveredCount(t *testing.T) {
+	tests := []struct {
+		name string
+		d    Delivery
+		want int
+	}{
+		{"first delivery", Delivery{}, 0},
+		{"classic queue redelivery", Delivery{Redelivered: true}, 1},
+		{"quorum queue count", Delivery{Redelivered: true, Headers: map[string]interface{}{brokerDeliveryCount: int64(3)}}, 3},
+	}
+	for _, tt := range tests {
+		if got := redeliveredCount(tt.d); got != tt.want {
+			t.Errorf("%s: redeliveredCount = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCountRedeliveries(t *testing.T) {
+	d := Delivery{Headers: map[string]interface{}{brokerDeliveryCount: int64(2), HeaderDeliveryCount: int32(1), HeaderAttempt: int32(2)}}
+	headers, exceeded := countRedeliveries(QueueOptions{MaxRedelivery: 3}, d, redeliveredCount(d))
+	if exceeded {
+		t.Error("3 deliveries exceeded MaxRedelivery 3")
+	}
+	if _, ok := headers[brokerDeliveryCount]; ok {
+		t.Errorf("%s kept on the republished message", brokerDeliveryCount)
+	}
+	if got := headerInt(headers, HeaderDeliveryCount); got != 3 {
+		t.Errorf("%s = %d, want 3", HeaderDeliveryCount, got)
+	}
+	if got := headerInt(headers, HeaderAttempt); got != 4 {
+		t.Errorf("%s = %d, want 4", HeaderAttempt, got)
+	}
+	if got := headerInt(d.Headers, HeaderDeliveryCount); got != 1 {
+		t.Errorf("countRedeliveries modified the delivery headers: %s = %d", HeaderDeliveryCount, got)
+	}
+	if _, exceeded := countRedeliveries(QueueOptions{MaxRedelivery: 3}, Delivery{Headers: headers, Redelivered: true}, 1); !exceeded {
+		t.Error("4 deliveries did not exceed MaxRedelivery 3")
+	}
+}
+
+func TestBumpAttempt(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]interface{}
+		n       int
+		want    int
+	}{
+		{"legacy message counts as the first attempt", nil, 1, 2},
+		{"attempt carried", map[string]interface{}{HeaderAttempt: int32(3)}, 1, 4},
+		{"several redeliveries", map[string]interface{}{HeaderAttempt: int32(1)}, 3, 4},
+	}
+	for _, tt := range tests {
+		headers := map[string]interface{}{}
+		bumpAttempt(headers, Delivery{Headers: tt.headers}, tt.n)
+		if got := headerInt(headers, HeaderAttempt); got != tt.want {
+			t.Errorf("%s: %s = %d, want %d", tt.name, HeaderAttempt, got, tt.want)
+		}
+	}
+}
+
+func TestDecideFailureUndecodable(t *testing.T) {
+	d := Delivery{Body: []byte("not gzip"), ContentEncoding: EncodingGzip, Headers: map[string]interface{}{HeaderAttempt: int32(1)}}
+	err := fmt.Errorf("%w: gzip message: unexpected EOF", ErrUndecodable)
+
+	action, headers := decideFailure(QueueOptions{DeadLetter: true, MaxRedelivery: 5}, d, err)
+	if action != failureQuarantine {
+		t.Fatalf("action = %d, want quarantine", action)
+	}
+	if _, ok := headers[HeaderDeliveryCount]; ok {
+		t.Errorf("undecodable message counted as a delivery: %v", headers)
+	}
+	if got := headerInt(headers, HeaderAttempt); got != 1 {
+		t.Errorf("%s = %d, want 1", HeaderAttempt, got)
+	}
+	if headers[HeaderLastError] != err.Error() {
+		t.Errorf("%s = %v, want %q", HeaderLastError, headers[HeaderLastError], err)
+	}
+
+	if action, headers := decideFailure(QueueOptions{DeadLetter: true}, d, err); action != failureDrop || headers != nil {
+		t.Errorf("without a quarantine queue got %d, %v, want drop", action, headers)
+	}
+}
+
+func TestDecideFailureInProgress(t *testing.T) {
+	d := Delivery{Body: []byte(testTaskBody), Headers: map[string]interface{}{HeaderAttempt: int32(2), HeaderDeliveryCount: int32(1)}}
+	err := fmt.Errorf("claim: %w", ErrMessageInProgress)
+	for _, opts := range []QueueOptions{{}, {DeadLetter: true}, {DeadLetter: true, MaxRedelivery: 1}} {
+		action, headers := decideFailure(opts, d, err)
+		if action != failureDefer {
+			t.Errorf("%+v: action = %d, want defer", opts, action)
+			continue
+		}
+		if headerInt(headers, HeaderAttempt) != 2 || headerInt(headers, HeaderDeliveryCount) != 1 {
+			t.Errorf("%+v: headers = %v, want the original counts", opts, headers)
+		}
+		if _, ok := headers[HeaderLastError]; ok {
+			t.Errorf("%+v: in-progress duplicate recorded as a failure", opts)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package taskmanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/onedotnet/asynctasks/database"
+	"gorm.io/gorm"
+)
+
+const (
+	// ControlCancel 取消任务的控制命令
+	ControlCancel = "cancel"
+	// maxCancelAttempts 取消命令最多发送的次数, 超过后 ResendCancellations 不再发送
+	maxCancelAttempts = 10
+)
+
+var (
+	// ErrTaskCancelled 任务已经被取消
+	ErrTaskCancelled = errors.New("task - cancelled")
+)
+
+// ControlMessage 发给节点的控制消息, 通过节点自己的控制 exchange 投递
+type ControlMessage struct {
+	Command   string    `json:"command"`
+	ID        int64     `json:"id"`
+	MessageID uuid.UUID `json:"message_id"`
+	Reason    string    `json:"reason"`
+	IssuedAt  time.Time `json:"issued_at"`
+}
+
+// TaskCancellation 发给执行节点的一次取消请求, 节点确认后写入 AckedAt
+type TaskCancellation struct {
+	ID         int64      `json:"id" gorm:"primary_key"`
+	TaskID     int64      `json:"task_id" gorm:"index"`
+	MessageID  uuid.UUID  `json:"message_id" gorm:"type:uuid;index"`
+	Node       string     `json:"node" gorm:"varchar(255)"`
+	Reason     string     `json:"reason" gorm:"type:text"`
+	Actor      string     `json:"actor" gorm:"varchar(255)"`
+	Attempts   int        `json:"attempts" gorm:"default:0"`
+	LastError  string     `json:"last_error" gorm:"type:text"`
+	SentAt     *time.Time `json:"sent_at" gorm:"index"`
+	AckedAt    *time.Time `json:"acked_at"`
+	AckMessage string     `json:"ack_message" gorm:"type:text"`
+	CreatedAt  time.Time  `json:"created_at" gorm:"default:now()"`
+	UpdatedAt  time.Time  `json:"updated_at" gorm:"default:now()"`
+}
+
+// ControlExchange 节点的控制 exchange
+func ControlExchange(node string) string {
+	return defaultExchange + ".control." + node
+}
+
+// ControlQueue 节点的控制队列
+func ControlQueue(node string) string {
+	return ControlExchange(node)
+}
+
+// NewControlBroker 创建节点 node 的控制队列, 节点用它消费控制消息
+// 节点启动时声明控制队列, manager 通过 DefaultBroker 的连接发布到 ControlExchange(node), 不为每个节点打开连接;
+// 控制消息处理失败时保持 requeue, 不计数也不隔离
+func NewControlBroker(node string) (Broker, error) {
+	opts := DefaultQueueOptions()
+	opts.DeadLetter = false
+	opts.MaxRedelivery = 0
+	return NewBroker(ControlExchange(node), ExchangeFanout, "", ControlQueue(node), opts)
+}
+
+// abandonOutboxTx 在事务 tx 中放弃任务还没有投递的 outbox 消息
+func abandonOutboxTx(tx *gorm.DB, taskID int64, reason error) error {
+	now := time.Now()
+	return tx.Model(&OutboxMessage{}).
+		Where("task_id = ? AND sent_at IS NULL AND failed_at IS NULL", taskID).
+		Updates(map[string]interface{}{
+			"last_error": reason.Error(),
+			"failed_at":  now,
+			"updated_at": now,
+		}).Error
+}
+
+// Cancel 把任务置为 cancelled 并放弃还没有投递的 outbox 消息
+// 任务的消息已经投递到节点 (pending 并且有节点) 或者正在节点上执行时, 记录一条 TaskCancellation
+// 并通过节点的控制 exchange 通知节点, 节点据此跳过队列中的消息或停止执行 (见 SkipCancelled);
+// 发送失败时返回的 TaskCancellation.SentAt 为空, 由 ResendCancellations 继续发送
+func (t *Task) Cancel(ctx context.Context, actor, reason string) (*TaskCancellation, error) {
+	var c *TaskCancellation
+	err := database.DB().Transaction(func(tx *gorm.DB) error {
+		current, err := lockTask(tx, t.ID, t.MessageID)
+		if err != nil {
+			return err
+		}
+		from := current.Status
+		current.Status = TASK_CANCELLED
+		if err := current.updateTx(tx, from, actor, reason); err != nil {
+			return err
+		}
+		if err := abandonOutboxTx(tx, current.ID, ErrTaskCancelled); err != nil {
+			return err
+		}
+		*t = *current
+		if current.Node == "" || (from != TASK_PENDING && from != TASK_INPROGRESS) {
+			return nil
+		}
+
+		c = &TaskCancellation{
+			TaskID:    current.ID,
+			MessageID: current.MessageID,
+			Node:      current.Node,
+			Reason:    reason,
+			Actor:     actor,
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		}
+		return tx.Create(c).Error
+	})
+	if err != nil || c == nil {
+		return c, err
+	}
+
+	if err := c.Send(ctx); err != nil {
+		slog.Warn("cancel - send to node failed, left for resend", "message_id", t.MessageID, "node", c.Node, "error", err)
+	}
+	return c, nil
+}
+
+// cancelDeliveredTx 任务在 relay 投递消息期间被取消时, 在事务 tx 中为收到消息的节点 node
+// 记录一条取消命令, 由 ResendCancellations 发送
+func cancelDeliveredTx(tx *gorm.DB, o *OutboxMessage, node string) error {
+	var task Task
+	if err := tx.Select("id", "status").Where("id = ?", o.TaskID).First(&task).Error; err != nil {
+		return err
+	}
+	if task.Status != TASK_CANCELLED {
+		return nil
+	}
+	slog.Warn("cancel - task cancelled while being relayed, node will be notified", "message_id", o.MessageID, "node", node)
+	return tx.Create(&TaskCancellation{
+		TaskID:    o.TaskID,
+		MessageID: o.MessageID,
+		Node:      node,
+		Reason:    ErrTaskCancelled.Error(),
+		Actor:     ActorOutbox,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}).Error
+}
+
+// Send 通过 DefaultBroker 把取消命令发布到节点的控制 exchange 并记录结果
+func (c *TaskCancellation) Send(ctx context.Context) error {
+	body, err := json.Marshal(ControlMessage{
+		Command:   ControlCancel,
+		ID:        c.ID,
+		MessageID: c.MessageID,
+		Reason:    c.Reason,
+		IssuedAt:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	// 节点还没有声明控制队列时返回 ErrUnroutable, 由 ResendCancellations 继续发送
+	err = DefaultBroker.PublishMessageToExchange(ctx, ControlExchange(c.Node), "", Message{
+		Body:        body,
+		ContentType: ContentTypeJSON,
+		MessageID:   fmt.Sprintf("cancel-%d", c.ID),
+		Type:        ControlCancel,
+		Timestamp:   time.Now(),
+	})
+
+	now := time.Now()
+	c.Attempts++
+	c.UpdatedAt = now
+	updates := map[string]interface{}{
+		"attempts":   c.Attempts,
+		"updated_at": now,
+	}
+	if err != nil {
+		c.LastError = err.Error()
+		updates["last_error"] = c.LastError
+	} else {
+		c.SentAt = &now
+		updates["sent_at"] = now
+	}
+	if saveErr := database.DB().Model(c).Updates(updates).Error; saveErr != nil {
+		slog.Error("cancel - record send result failed", "id", c.ID, "error", saveErr)
+	}
+	return err
+}
+
+// ResendCancellations 重新发送还没有发送成功的取消命令, 由后台定时执行
+// 每条命令最多发送 maxCancelAttempts 次
+// 节点处理取消命令是幂等的, 多个 manager 实例重复发送没有影响
+func ResendCancellations() {
+	var pending []TaskCancellation
+	if err := database.DB().Where("sent_at IS NULL AND acked_at IS NULL AND attempts < ?", maxCancelAttempts).
+		Order("id").Limit(outboxBatchSize).Find(&pending).Error; err != nil {
+		slog.Error("cancel - list unsent cancellations failed", "error", err)
+		return
+	}
+	for i := range pending {
+		c := &pending[i]
+		if err := c.Send(context.Background()); err != nil {
+			if c.Attempts >= maxCancelAttempts {
+				slog.Error("cancel - giving up", "message_id", c.MessageID, "node", c.Node, "attempts", c.Attempts, "error", err)
+				continue
+			}
+			slog.Warn("cancel - resend failed", "message_id", c.MessageID, "node", c.Node, "error", err)
+		}
+	}
+}
+
+// AckCancellation 记录节点对任务最近一次取消命令的确认
+func AckCancellation(uid uuid.UUID, node, message string) (*TaskCancellation, error) {
+	var c TaskCancellation
+	err := database.DB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("message_id = ? AND node = ?", uid, node).
+			Order("id DESC").First(&c).Error; err != nil {
+			return err
+		}
+		if c.AckedAt != nil {
+			return nil
+		}
+		now := time.Now()
+		c.AckedAt = &now
+		c.AckMessage = message
+		c.UpdatedAt = now
+		return tx.Model(&c).Updates(map[string]interface{}{
+			"acked_at":    now,
+			"ack_message": message,
+			"updated_at":  now,
+		}).Error
+	})
+	return &c, err
+}
+
+// GetTaskCancellations 按时间顺序列出任务的取消命令
+func GetTaskCancellations(taskID int64) ([]TaskCancellation, error) {
+	var cancellations []TaskCancellation
+	err := database.DB().Where("task_id = ?", taskID).Order("id").Find(&cancellations).Error
+	return cancellations, err
+}
+
+// ControlHandler 把控制队列中的消息解码为 ControlMessage 交给 handle, 节点使用
+func ControlHandler(handle func(ctx context.Context, msg ControlMessage) error) DeliveryHandler {
+	return func(ctx context.Context, d Delivery) error {
+		var msg ControlMessage
+		if err := json.Unmarshal(d.Body, &msg); err != nil {
+			slog.Warn("control - invalid message, dropped", "message_id", d.MessageID, "error", err)
+			return nil
+		}
+		return handle(ctx, msg)
+	}
+}
+
+// CancelledMessages 节点收到的取消命令, 记录被取消任务的消息 ID, 保留 ttl 后忘记
+// 节点用 Track 包装控制队列的处理函数, 再用 SkipCancelled 包装任务队列的 handler
+type CancelledMessages struct {
+	mu  sync.Mutex
+	ttl time.Duration
+	ids map[string]time.Time
+}
+
+// NewCancelledMessages 创建一个空的 CancelledMessages
+func NewCancelledMessages(ttl time.Duration) *CancelledMessages {
+	return &CancelledMessages{ttl: ttl, ids: map[string]time.Time{}}
+}
+
+// Add 记录被取消的消息 ID, 同时清理过期的记录
+func (c *CancelledMessages) Add(messageID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for id, expires := range c.ids {
+		if now.After(expires) {
+			delete(c.ids, id)
+		}
+	}
+	c.ids[messageID] = now.Add(c.ttl)
+}
+
+// Contains 消息 ID 是否被取消
+func (c *CancelledMessages) Contains(messageID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires, ok := c.ids[messageID]
+	return ok && time.Now().Before(expires)
+}
+
+// Track 记录取消命令, 再交给 handle 处理 (例如停止正在执行的任务), 和 ControlHandler 一起使用
+func (c *CancelledMessages) Track(handle func(ctx context.Context, msg ControlMessage) error) func(ctx context.Context, msg ControlMessage) error {
+	return func(ctx context.Context, msg ControlMessage) error {
+		if msg.Command == ControlCancel {
+			c.Add(msg.MessageID.String())
+		}
+		return handle(ctx, msg)
+	}
+}
+
+// SkipCancelled 跳过节点已经收到取消命令的消息, 直接 ack 而不调用 handler
+// 取消状态通过节点的控制队列送达, 节点不需要访问数据库
+func SkipCancelled(cancelled *CancelledMessages, handler DeliveryHandler) DeliveryHandler {
+	return func(ctx context.Context, d Delivery) error {
+		messageID := d.MessageID
+		if env, err := OpenEnvelope(d); err == nil && env.MessageID != "" {
+			messageID = env.MessageID
+		}
+		if messageID != "" && cancelled.Contains(messageID) {
+			slog.Info("cancel - task cancelled, message skipped", "message_id", messageID)
+			return nil
+		}
+		return handler(ctx, d)
+	}
+}
@@ -0,0 +1,106 @@
+package taskmanager
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// testRunningTask 创建一个正在节点 node 上执行的任务
+func testRunningTask(t *testing.T, node string) *Task {
+	t.Helper()
+	task := &Task{Name: "test", MessageID: uuid.New(), TaskType: TASK_TYPE_VIDEO, Status: TASK_INPROGRESS, Node: node}
+	if err := CreateTask(task); err != nil {
+		t.Fatal(err)
+	}
+	return task
+}
+
+func TestCancelSendsControlMessage(t *testing.T) {
+	db := testDB(t)
+	bus := useMemoryBroker(t)
+	control := NewMemoryBroker(bus, ControlExchange("node-a"), ExchangeFanout, "", ControlQueue("node-a"))
+	if err := control.Declare(); err != nil {
+		t.Fatal(err)
+	}
+	task := testRunningTask(t, "node-a")
+
+	c, err := task.Cancel(context.Background(), "test", "stop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Status != TASK_CANCELLED {
+		t.Errorf("task status = %s, want %s", task.Status, TASK_CANCELLED)
+	}
+	if c == nil || c.SentAt == nil || c.Attempts != 1 {
+		t.Fatalf("cancellation %+v, want sent once", c)
+	}
+
+	d, ok, _ := bus.pop(ControlQueue("node-a"))
+	if !ok {
+		t.Fatal("no control message on the node's queue")
+	}
+	var msg ControlMessage
+	if err := json.Unmarshal(d.Body, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Command != ControlCancel || msg.ID != c.ID || msg.MessageID != task.MessageID || msg.Reason != "stop" {
+		t.Errorf("control message %+v", msg)
+	}
+
+	var saved TaskCancellation
+	if err := db.First(&saved, c.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if saved.SentAt == nil || saved.Attempts != 1 {
+		t.Errorf("saved cancellation sent_at %v attempts %d", saved.SentAt, saved.Attempts)
+	}
+}
+
+func TestCancelLeavesUnsentForResend(t *testing.T) {
+	db := testDB(t)
+	useMemoryBroker(t)
+	// 节点还没有声明控制队列
+	task := testRunningTask(t, "node-a")
+
+	c, err := task.Cancel(context.Background(), "test", "stop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c == nil || c.SentAt != nil || c.Attempts != 1 || c.LastError == "" {
+		t.Fatalf("cancellation %+v, want one failed attempt", c)
+	}
+	var saved TaskCancellation
+	if err := db.First(&saved, c.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if saved.SentAt != nil || saved.LastError == "" {
+		t.Errorf("saved cancellation sent_at %v last_error %q, want it left for resend", saved.SentAt, saved.LastError)
+	}
+}
+
+func TestCancelAbandonsOutbox(t *testing.T) {
+	db := testDB(t)
+	o := testTask(t, db, &Task{TaskType: TASK_TYPE_VIDEO}, "")
+	task := &Task{ID: o.TaskID}
+
+	c, err := task.Cancel(context.Background(), "test", "stop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != nil {
+		t.Errorf("cancellation %+v for a task not on a node", c)
+	}
+	var saved OutboxMessage
+	if err := db.First(&saved, o.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if saved.FailedAt == nil || saved.LastError != ErrTaskCancelled.Error() {
+		t.Errorf("outbox failed_at %v last_error %q, want it abandoned", saved.FailedAt, saved.LastError)
+	}
+	if o, err := claimOutbox(context.Background(), 0); err != nil || o != nil {
+		t.Errorf("claimOutbox = %v, %v, want the cancelled task's message skipped", o, err)
+	}
+}
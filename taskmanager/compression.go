@@ -0,0 +1,129 @@
+package taskmanager
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// 消息体压缩算法, 对应 ContentEncoding 属性
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+
+	// maxDecompressedSize 解压后消息体的上限, 防止压缩炸弹
+	maxDecompressedSize = 64 << 20
+)
+
+var (
+	// ErrUnknownEncoding 消息的 ContentEncoding 不是支持的压缩算法
+	ErrUnknownEncoding = errors.New("compression - unknown content encoding")
+	// ErrUndecodable 消息体无法解压, 重试也不会成功
+	ErrUndecodable = errors.New("compression - cannot decompress message body")
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func initZstd() error {
+	zstdOnce.Do(func() {
+		if zstdEncoder, zstdErr = zstd.NewWriter(nil); zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedSize))
+	})
+	return zstdErr
+}
+
+// compressMessage 按 QueueOptions.Compression 压缩不小于 CompressionThreshold 的消息体并设置 ContentEncoding
+// 已经编码的消息、压缩后没有变小的消息和压缩失败的消息原样发布
+func compressMessage(opts QueueOptions, m Message) Message {
+	if opts.Compression == "" || m.ContentEncoding != "" || len(m.Body) < opts.CompressionThreshold {
+		return m
+	}
+	body, err := compress(opts.Compression, m.Body)
+	if err != nil {
+		slog.Warn("compression - compress failed, publishing uncompressed", "encoding", opts.Compression, "error", err)
+		return m
+	}
+	if len(body) >= len(m.Body) {
+		return m
+	}
+	m.Body = body
+	m.ContentEncoding = opts.Compression
+	return m
+}
+
+func compress(encoding string, body []byte) ([]byte, error) {
+	switch encoding {
+	case EncodingGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case EncodingZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdEncoder.EncodeAll(body, nil), nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownEncoding, encoding)
+}
+
+// decompressDelivery 按 ContentEncoding 解压消息体, 解压后清空 ContentEncoding
+// 没有编码的旧消息原样返回, 因此新旧消息可以混在同一个队列中; 解压失败时返回 ErrUndecodable 和原消息
+func decompressDelivery(d Delivery) (Delivery, error) {
+	var (
+		body []byte
+		err  error
+	)
+	switch d.ContentEncoding {
+	case "", "identity":
+		return d, nil
+	case EncodingGzip:
+		body, err = gunzip(d.Body)
+	case EncodingZstd:
+		if err = initZstd(); err == nil {
+			body, err = zstdDecoder.DecodeAll(d.Body, nil)
+		}
+	default:
+		err = fmt.Errorf("%w: %s", ErrUnknownEncoding, d.ContentEncoding)
+	}
+	if err != nil {
+		return d, fmt.Errorf("%w: %s message: %w", ErrUndecodable, d.ContentEncoding, err)
+	}
+	d.Body = body
+	d.ContentEncoding = ""
+	return d, nil
+}
+
+func gunzip(body []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	out, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxDecompressedSize {
+		return nil, fmt.Errorf("decompressed body exceeds %d bytes", maxDecompressedSize)
+	}
+	return out, nil
+}
@@ -0,0 +1,87 @@
+package taskmanager
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCompressMessage(t *testing.T) {
+	large := bytes.Repeat([]byte(`{"task_type":"video","payload":"frame"}`), 100)
+	tests := []struct {
+		name     string
+		opts     QueueOptions
+		m        Message
+		encoding string
+	}{
+		{"off", QueueOptions{CompressionThreshold: 1}, Message{Body: large}, ""},
+		{"gzip", QueueOptions{Compression: EncodingGzip, CompressionThreshold: 1024}, Message{Body: large}, EncodingGzip},
+		{"zstd", QueueOptions{Compression: EncodingZstd, CompressionThreshold: 1024}, Message{Body: large}, EncodingZstd},
+		{"below threshold", QueueOptions{Compression: EncodingGzip, CompressionThreshold: len(large) + 1}, Message{Body: large}, ""},
+		{"already encoded", QueueOptions{Compression: EncodingZstd}, Message{Body: large, ContentEncoding: EncodingGzip}, EncodingGzip},
+		{"not smaller", QueueOptions{Compression: EncodingGzip}, Message{Body: []byte("x")}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := compressMessage(tt.opts, tt.m)
+			if m.ContentEncoding != tt.encoding {
+				t.Fatalf("ContentEncoding = %q, want %q", m.ContentEncoding, tt.encoding)
+			}
+			if tt.encoding == "" && !bytes.Equal(m.Body, tt.m.Body) {
+				t.Fatal("uncompressed body changed")
+			}
+			if tt.encoding == "" || tt.m.ContentEncoding != "" {
+				return
+			}
+			d, err := decompressDelivery(Delivery{Body: m.Body, ContentEncoding: m.ContentEncoding})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.ContentEncoding != "" || !bytes.Equal(d.Body, tt.m.Body) {
+				t.Errorf("round trip got encoding %q and %d bytes, want the original %d bytes", d.ContentEncoding, len(d.Body), len(tt.m.Body))
+			}
+		})
+	}
+}
+
+func TestDecompressDelivery(t *testing.T) {
+	tests := []struct {
+		name     string
+		d        Delivery
+		want     string
+		wantErrs []error
+	}{
+		{"plain", Delivery{Body: []byte("plain")}, "plain", nil},
+		{"identity", Delivery{Body: []byte("plain"), ContentEncoding: "identity"}, "plain", nil},
+		{"corrupt gzip", Delivery{Body: []byte("plain"), ContentEncoding: EncodingGzip}, "plain", []error{ErrUndecodable}},
+		{"corrupt zstd", Delivery{Body: []byte("plain"), ContentEncoding: EncodingZstd}, "plain", []error{ErrUndecodable}},
+		{"unknown", Delivery{Body: []byte("plain"), ContentEncoding: "br"}, "plain", []error{ErrUndecodable, ErrUnknownEncoding}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := decompressDelivery(tt.d)
+			if (err != nil) != (len(tt.wantErrs) > 0) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErrs)
+			}
+			for _, want := range tt.wantErrs {
+				if !errors.Is(err, want) {
+					t.Errorf("error = %v, want %v", err, want)
+				}
+			}
+			// 解压失败时返回原消息, 可以原样隔离
+			if string(d.Body) != tt.want {
+				t.Errorf("body = %q, want %q", d.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestGunzipLimit(t *testing.T) {
+	body, err := compress(EncodingGzip, make([]byte, maxDecompressedSize+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decompressDelivery(Delivery{Body: body, ContentEncoding: EncodingGzip}); !errors.Is(err, ErrUndecodable) {
+		t.Fatalf("oversized body error = %v, want ErrUndecodable", err)
+	}
+}
@@ -0,0 +1,105 @@
+package taskmanager
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/onedotnet/asynctasks/config"
+	"github.com/onedotnet/asynctasks/database"
+	"gorm.io/gorm"
+)
+
+// testDB 连接 TEST_DB_* 指定的 PostgreSQL, 迁移并清空任务相关的表; 没有设置 TEST_DB_HOST 时跳过
+// 注意: 这些表会被 TRUNCATE, 只能指向测试用的数据库
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	host := os.Getenv("TEST_DB_HOST")
+	if host == "" {
+		t.Skip("TEST_DB_HOST not set")
+	}
+	port, err := strconv.Atoi(testEnv("TEST_DB_PORT", "5432"))
+	if err != nil {
+		t.Fatalf("invalid TEST_DB_PORT: %v", err)
+	}
+
+	prev := config.AppConfig
+	config.AppConfig = &config.Config{
+		DBHost:               host,
+		DBPort:               port,
+		DBUser:               testEnv("TEST_DB_USER", "postgres"),
+		DBPassword:           os.Getenv("TEST_DB_PASS"),
+		DBName:               testEnv("TEST_DB_NAME", "asynctasks_test"),
+		DBSSL:                testEnv("TEST_DB_SSL", "disable"),
+		QueueBackend:         "postgres",
+		RMQWorkers:           1,
+		RetryStrategy:        "exponential",
+		RetryBaseDelay:       5,
+		RetryMaxDelay:        300,
+		RetryExhaustedStatus: TASK_DEAD_LETTERED,
+	}
+	db, err := database.Open(config.AppConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		database.Close()
+		config.AppConfig = prev
+	})
+
+	if err := db.AutoMigrate(&TaskNode{}, &Task{}, &TaskEvent{}, &TaskCancellation{}, &TaskTypePause{},
+		&OutboxMessage{}, &QueueMessage{}, &QueueBinding{}, &ProcessedMessage{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec(`TRUNCATE task_nodes, tasks, task_events, task_cancellations, task_type_pauses,
+		outbox_messages, task_queue, task_queue_bindings, processed_messages RESTART IDENTITY`).Error; err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func testEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// testTask 创建一个任务和它发往 route 的 outbox 消息, 消息立即可以投递
+func testTask(t *testing.T, db *gorm.DB, task *Task, route string) *OutboxMessage {
+	t.Helper()
+	task.MessageID = uuid.New()
+	if task.Name == "" {
+		task.Name = "test"
+	}
+	o, err := CreateTaskWithOutbox(task, route, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 以数据库的时钟为准
+	testExec(t, db, "UPDATE outbox_messages SET next_attempt_at = now() - interval '1 minute' WHERE id = ?", o.ID)
+	return o
+}
+
+func testExec(t *testing.T, db *gorm.DB, sql string, values ...interface{}) {
+	t.Helper()
+	if err := db.Exec(sql, values...).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// useMemoryBroker 把 DefaultBroker 换成绑定了 routes 的 MemoryBroker, 测试结束后恢复
+func useMemoryBroker(t *testing.T, routes ...string) *MemoryBus {
+	t.Helper()
+	bus := NewMemoryBus()
+	for _, route := range routes {
+		if err := NewMemoryBroker(bus, defaultExchange, ExchangeDirect, route, route).Declare(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	prev := DefaultBroker
+	DefaultBroker = NewMemoryBroker(bus, defaultExchange, ExchangeDirect, "", "manager")
+	t.Cleanup(func() { DefaultBroker = prev })
+	return bus
+}
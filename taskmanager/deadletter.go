@@ -0,0 +1,211 @@
+package taskmanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/google/uuid"
+	"github.com/onedotnet/asynctasks/database"
+	"github.com/streadway/amqp"
+	"gorm.io/gorm"
+)
+
+const (
+	HeaderLastError          = "x-last-error"
+	HeaderOriginalExchange   = "x-original-exchange"
+	HeaderOriginalRoutingKey = "x-original-routing-key"
+
+	// HeaderDeliveryCount 本包记录的投递次数; 不使用 x-delivery-count, 它是 quorum 队列由 broker 维护的 header
+	HeaderDeliveryCount = "x-asynctasks-delivery-count"
+
+	deadLetterRecorderQueue = "onedotnet.asynctask.dead_lettered"
+)
+
+// ErrNotDeadLettered 任务存在但不是 dead_lettered
+var ErrNotDeadLettered = errors.New("task - not dead-lettered")
+
+// DeadLetterBroker 订阅死信 exchange 上的所有消息, 把失败的任务交给重试引擎
+var DeadLetterBroker Broker
+
+// isTaskBody 消息体是否是 Task (带有 message_id 和 max_retry)
+func isTaskBody(body []byte) bool {
+	var t struct {
+		MessageID *uuid.UUID `json:"message_id"`
+		MaxRetry  *int       `json:"max_retry"`
+	}
+	return json.Unmarshal(body, &t) == nil && t.MessageID != nil && t.MaxRetry != nil
+}
+
+// headerInt 读取整数类型的 header, 不存在时返回 0
+func headerInt(headers map[string]interface{}, key string) int {
+	switch v := headers[key].(type) {
+	case int:
+		return v
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case float64:
+		// 从 JSON 中读出的 headers, 例如 outbox
+		return int(v)
+	}
+	return 0
+}
+
+// deadLetterReason 优先使用 handleFailure 记录的错误, 否则使用 broker 的 x-death 原因
+func deadLetterReason(headers map[string]interface{}) string {
+	if reason, ok := headers[HeaderLastError].(string); ok && reason != "" {
+		return reason
+	}
+	if deaths, ok := headers["x-death"].([]interface{}); ok && len(deaths) > 0 {
+		if death, ok := deaths[0].(amqp.Table); ok {
+			return fmt.Sprintf("dead-lettered by broker: %v from queue %v", death["reason"], death["queue"])
+		}
+	}
+	return "dead-lettered"
+}
+
+// recordDeadLetter 处理转入死信的任务消息
+// 节点处理任务失败时消息直接转入死信, 由这里交给 failTx: 重试次数只由数据库中的 Task.Retried 计数,
+// 没有用完时安排重试并从死信队列中删除这条消息, 用完后任务置为 RETRY_EXHAUSTED_STATUS;
+// 节点已经上报过失败 (任务是 failed/retrying) 时是同一次失败, 不再计数; 已过截止时间的任务更新为 TASK_EXPIRED
+func recordDeadLetter(_ context.Context, delivery Delivery) error {
+	var msg Task
+	if err := json.Unmarshal(delivery.Body, &msg); err != nil || msg.MessageID == uuid.Nil {
+		// 不是任务消息, 记录后丢弃
+		slog.Warn("dead letter - not a task message", "routing_key", delivery.RoutingKey)
+		return nil
+	}
+
+	reason := deadLetterReason(delivery.Headers)
+	var retrying bool
+	err := database.DB().Transaction(func(tx *gorm.DB) error {
+		task, err := lockTask(tx, 0, msg.MessageID)
+		if err != nil {
+			return err
+		}
+		if task.IsExpired() {
+			// broker 按 expiration 丢弃的过期消息
+			return expireTaskTx(tx, task, ActorDeadLetter)
+		}
+
+		from := task.Status
+		switch from {
+		case TASK_FAILED, TASK_RETRYING, TASK_DEAD_LETTERED:
+			slog.Info("dead letter - failure already recorded", "message_id", msg.MessageID, "status", from)
+			return nil
+		}
+		task.Errors = append(task.Errors, reason)
+		if err := task.failTx(tx, from, ActorDeadLetter, reason, "errors"); err != nil {
+			return err
+		}
+		retrying = task.Status == TASK_RETRYING
+		return nil
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		slog.Warn("dead letter - task not found", "message_id", msg.MessageID, "error", err)
+		return nil
+	case errors.Is(err, ErrIllegalTransition):
+		// 任务已经完成或取消, 死信消息只记录不再改变状态
+		slog.Warn("dead letter - task status not changed", "message_id", msg.MessageID, "error", err)
+		return nil
+	case err != nil:
+		return err
+	}
+
+	if retrying && delivery.RoutingKey != "" {
+		// 任务会重新投递, 死信队列中的这条消息已经没有用了
+		removeDeadLetterCopy(delivery.RoutingKey+".dlq", msg.MessageID)
+	}
+	return nil
+}
+
+// StartDeadLetterRecorder 启动死信记录队列
+func StartDeadLetterRecorder() error {
+	dl, ok := DefaultBroker.(interface{ DeadLetterExchange() string })
+	if !ok {
+		return fmt.Errorf("broker %T has no dead letter exchange", DefaultBroker)
+	}
+
+	opts := DefaultQueueOptions()
+	opts.DeadLetter = false
+	// 按 expiration 过期的任务消息也会转入死信, 需要把任务置为 expired
+	opts.KeepExpired = true
+	broker, err := NewBroker(dl.DeadLetterExchange(), ExchangeTopic, "#", deadLetterRecorderQueue, opts)
+	if err != nil {
+		return err
+	}
+	DeadLetterBroker = broker
+	return broker.Consume(IdempotentBy(deadLetterRecorderQueue, IdempotencyTTL(), deadLetterKey, recordDeadLetter))
+}
+
+// deadLetterKey 死信去重的 key: 消息 ID 加上发布时间
+// 每次投递 (重试、redrive) 都从新的 outbox 消息发布, 发布时间不同, 只有同一条死信的重复投递会被跳过
+func deadLetterKey(d Delivery) string {
+	id := messageKey(d)
+	if id == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s@%d", id, d.Timestamp.Unix())
+}
+
+// GetDeadLetteredTasks 分页列出 dead_lettered 的任务, 最近的在前
+func GetDeadLetteredTasks(limit, offset int) ([]Task, error) {
+	var tasks []Task
+	err := database.DB().Where("status = ?", TASK_DEAD_LETTERED).
+		Order("updated_at DESC").Limit(limit).Offset(offset).Find(&tasks).Error
+	return tasks, err
+}
+
+// GetDeadLetteredTask 获取一个 dead_lettered 的任务
+func GetDeadLetteredTask(uid uuid.UUID) (*Task, error) {
+	task, err := GetTaskByUUID(uid)
+	if err != nil {
+		return nil, err
+	}
+	if task.Status != TASK_DEAD_LETTERED {
+		return nil, fmt.Errorf("%w: task %s is %s", ErrNotDeadLettered, uid, task.Status)
+	}
+	return task, nil
+}
+
+// Redrive 重新投递一个 dead_lettered 的任务, 清零重试次数并重新分配节点
+// 任务状态和 outbox 消息在同一个事务中写入, 立即投递失败时由 relay 继续投递;
+// 之后从节点的死信队列 (<node>.dlq) 中删除这条任务的旧消息, 删除失败只记录日志
+func (t *Task) Redrive(ctx context.Context) (*OutboxMessage, error) {
+	if t.Status != TASK_DEAD_LETTERED {
+		return nil, fmt.Errorf("%w: task %s is %s", ErrNotDeadLettered, t.MessageID, t.Status)
+	}
+
+	node := t.Node
+	t.Status = TASK_PENDING
+	t.Retried = 0
+	o, err := DispatchTask(ctx, t, ActorAPI, "redrive")
+	if err != nil {
+		return nil, err
+	}
+
+	if node != "" {
+		removeDeadLetterCopy(node+".dlq", t.MessageID)
+	}
+	return o, nil
+}
+
+// removeDeadLetterCopy 从死信队列 dlq 中删除任务的消息, 删除失败只记录日志
+func removeDeadLetterCopy(dlq string, messageID uuid.UUID) {
+	remover, ok := DefaultBroker.(MessageRemover)
+	if !ok {
+		return
+	}
+	if removed, err := remover.RemoveMessages(dlq, messageID.String()); err != nil {
+		slog.Warn("dead letter - remove message from dead letter queue failed", "queue", dlq, "message_id", messageID, "error", err)
+	} else if removed > 0 {
+		slog.Info("dead letter - removed message from dead letter queue", "queue", dlq, "message_id", messageID, "removed", removed)
+	}
+}
@@ -0,0 +1,58 @@
+package taskmanager
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestIsTaskBody(t *testing.T) {
+	tests := []struct {
+		body string
+		want bool
+	}{
+		{`{"message_id":"7f1d2a4e-8a61-4c4e-9f59-2f6a3c1b0d55","max_retry":3}`, true},
+		{`{"message_id":"7f1d2a4e-8a61-4c4e-9f59-2f6a3c1b0d55","max_retry":0}`, true},
+		{`{"message_id":"7f1d2a4e-8a61-4c4e-9f59-2f6a3c1b0d55"}`, false},
+		{`{"max_retry":3}`, false},
+		{`{"message_id":"not a uuid","max_retry":3}`, false},
+		{`not json`, false},
+	}
+	for _, tt := range tests {
+		if got := isTaskBody([]byte(tt.body)); got != tt.want {
+			t.Errorf("isTaskBody(%s) = %v, want %v", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestHeaderInt(t *testing.T) {
+	headers := amqp.Table{
+		"int":    3,
+		"int16":  int16(4),
+		"int32":  int32(5),
+		"int64":  int64(6),
+		"string": "7",
+	}
+	for key, want := range map[string]int{"int": 3, "int16": 4, "int32": 5, "int64": 6, "string": 0, "missing": 0} {
+		if got := headerInt(headers, key); got != want {
+			t.Errorf("headerInt(%s) = %d, want %d", key, got, want)
+		}
+	}
+}
+
+func TestDeadLetterReason(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers amqp.Table
+		want    string
+	}{
+		{"handler error", amqp.Table{HeaderLastError: "boom", "x-death": []interface{}{amqp.Table{"reason": "rejected"}}}, "boom"},
+		{"broker death", amqp.Table{"x-death": []interface{}{amqp.Table{"reason": "expired", "queue": "video"}}}, "dead-lettered by broker: expired from queue video"},
+		{"unknown", amqp.Table{}, "dead-lettered"},
+	}
+	for _, tt := range tests {
+		if got := deadLetterReason(tt.headers); got != tt.want {
+			t.Errorf("%s: deadLetterReason = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package taskmanager
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/onedotnet/asynctasks/database"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// expireBatchSize 每次最多处理的过期任务数
+const expireBatchSize = 100
+
+// ErrTaskExpired 任务的截止时间已过
+var ErrTaskExpired = errors.New("task - deadline passed")
+
+// expirableStatuses 截止时间过后需要置为 expired 的状态
+var expirableStatuses = []string{TASK_PENDING, TASK_DELAYED, TASK_INPROGRESS, TASK_RETRYING, TASK_PAUSED}
+
+// IsExpired 任务设置了 Deadline 并且已经过期
+func (t *Task) IsExpired() bool {
+	return t.Deadline > 0 && time.Now().Unix() >= t.Deadline
+}
+
+// headerDeadline 读取 x-deadline header, 不存在时返回 0
+func headerDeadline(headers map[string]interface{}) int64 {
+	return int64(headerInt(headers, HeaderDeadline))
+}
+
+// expirationUntil 距离截止时间 deadline 的 AMQP expiration, 已过期时为 1ms 让 broker 尽快丢弃
+func expirationUntil(deadline int64) time.Duration {
+	ttl := time.Until(time.Unix(deadline, 0))
+	if ttl < time.Millisecond {
+		return time.Millisecond
+	}
+	return ttl
+}
+
+// DropExpired 跳过 x-deadline 已过的消息, 直接 ack 而不调用 handler
+// 三种 Broker 消费时默认都会使用它 (见 QueueOptions.KeepExpired);
+// 不使用本包的节点应当自己检查 x-deadline (unix 秒), 过期的消息直接 ack 而不执行,
+// RabbitMQ 上消息还带有 expiration, 在队列中过期时由 broker 丢弃或转入死信
+func DropExpired(handler DeliveryHandler) DeliveryHandler {
+	return func(ctx context.Context, d Delivery) error {
+		if deadline := headerDeadline(d.Headers); deadline > 0 && time.Now().Unix() >= deadline {
+			slog.Warn("deadline - message expired, dropped", "message_id", d.MessageID, "deadline", deadline)
+			return nil
+		}
+		return handler(ctx, d)
+	}
+}
+
+// consumeHandler 按队列选项包装 handler, 默认丢弃 x-deadline 已过的消息
+func consumeHandler(opts QueueOptions, handler DeliveryHandler) DeliveryHandler {
+	if opts.KeepExpired {
+		return handler
+	}
+	return DropExpired(handler)
+}
+
+// expireTaskTx 在事务 tx 中把任务置为 expired, 并放弃它还没有投递的 outbox 消息
+// 任务已经处于终止状态时只记录日志
+func expireTaskTx(tx *gorm.DB, t *Task, actor string) error {
+	if err := abandonOutboxTx(tx, t.ID, ErrTaskExpired); err != nil {
+		return err
+	}
+	if err := t.transitionTx(tx, TASK_EXPIRED, actor, ErrTaskExpired.Error()); err != nil {
+		if !errors.Is(err, ErrIllegalTransition) {
+			return err
+		}
+		slog.Warn("deadline - task status not changed", "message_id", t.MessageID, "error", err)
+		return nil
+	}
+	slog.Warn("deadline - task expired", "message_id", t.MessageID, "deadline", t.Deadline)
+	return nil
+}
+
+// ExpireTasks 把截止时间已过且没有结束的任务置为 expired, 由后台定时执行
+// 行锁使用 SKIP LOCKED, 多个 manager 实例同时运行时不会重复处理
+func ExpireTasks() {
+	for {
+		expired, err := expireTaskBatch()
+		if err != nil {
+			slog.Error("expire tasks failed", "error", err)
+			return
+		}
+		if expired < expireBatchSize {
+			return
+		}
+	}
+}
+
+func expireTaskBatch() (int, error) {
+	expired := 0
+	err := database.DB().Transaction(func(tx *gorm.DB) error {
+		var tasks []Task
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("deadline > 0 AND deadline <= ? AND status IN ?", time.Now().Unix(), expirableStatuses).
+			Order("deadline, id").Limit(expireBatchSize).Find(&tasks).Error; err != nil {
+			return err
+		}
+
+		for i := range tasks {
+			if err := expireTaskTx(tx, &tasks[i], ActorScheduler); err != nil {
+				return err
+			}
+			expired++
+		}
+		return nil
+	})
+	return expired, err
+}
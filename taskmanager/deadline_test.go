@@ -0,0 +1,106 @@
+package taskmanager
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestDropExpired(t *testing.T) {
+	called := 0
+	handler := DropExpired(func(context.Context, Delivery) error {
+		called++
+		return nil
+	})
+	past := time.Now().Add(-time.Minute).Unix()
+	future := time.Now().Add(time.Minute).Unix()
+	for _, d := range []Delivery{
+		{Headers: map[string]interface{}{HeaderDeadline: past}},
+		{Headers: map[string]interface{}{HeaderDeadline: future}},
+		{},
+	} {
+		if err := handler(context.Background(), d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if called != 2 {
+		t.Errorf("handler called %d times, want 2", called)
+	}
+}
+
+func TestDeliverOutboxExpired(t *testing.T) {
+	db := testDB(t)
+	bus := useMemoryBroker(t, "node-a")
+	task := &Task{TaskType: TASK_TYPE_VIDEO, Deadline: time.Now().Add(-time.Minute).Unix()}
+	testTask(t, db, task, "node-a")
+
+	o, err := claimOutbox(context.Background(), 0)
+	if err != nil || o == nil {
+		t.Fatalf("claimOutbox = %v, %v", o, err)
+	}
+	outcome, err := deliverOutbox(context.Background(), o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(outcome, ErrTaskExpired) {
+		t.Fatalf("outcome = %v, want ErrTaskExpired", outcome)
+	}
+	if _, ok, _ := bus.pop("node-a"); ok {
+		t.Error("expired task published to the node")
+	}
+
+	var saved Task
+	if err := db.First(&saved, task.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if saved.Status != TASK_EXPIRED {
+		t.Errorf("task status = %s, want %s", saved.Status, TASK_EXPIRED)
+	}
+	var held OutboxMessage
+	if err := db.First(&held, o.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if held.FailedAt == nil || held.SentAt != nil {
+		t.Errorf("outbox failed_at %v sent_at %v, want it abandoned", held.FailedAt, held.SentAt)
+	}
+}
+
+func TestExpireTasks(t *testing.T) {
+	db := testDB(t)
+	past := time.Now().Add(-time.Minute).Unix()
+	tasks := map[string]*Task{
+		"overdue":   {Status: TASK_PENDING, Deadline: past},
+		"running":   {Status: TASK_INPROGRESS, Deadline: past},
+		"done":      {Status: TASK_COMPLETED, Deadline: past},
+		"in time":   {Status: TASK_PENDING, Deadline: time.Now().Add(time.Hour).Unix()},
+		"no limits": {Status: TASK_PENDING},
+	}
+	for name, task := range tasks {
+		task.Name, task.MessageID, task.TaskType = name, uuid.New(), TASK_TYPE_VIDEO
+		if err := CreateTask(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ExpireTasks()
+
+	want := map[string]string{
+		"overdue":   TASK_EXPIRED,
+		"running":   TASK_EXPIRED,
+		"done":      TASK_COMPLETED,
+		"in time":   TASK_PENDING,
+		"no limits": TASK_PENDING,
+	}
+	for name, task := range tasks {
+		var saved Task
+		if err := db.First(&saved, task.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		if saved.Status != want[name] {
+			t.Errorf("%s task status = %s, want %s", name, saved.Status, want[name])
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package taskmanager
+
+import (
+	"context"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Delivery 交给 DeliveryHandler 的消息及其元数据
+type Delivery struct {
+	Body            []byte
+	Headers         map[string]interface{}
+	MessageID       string
+	CorrelationID   string
+	ContentType     string
+	ContentEncoding string
+	Type            string
+	ReplyTo         string
+	Priority        uint8
+	Timestamp       time.Time
+	Redelivered     bool
+	Exchange        string
+	RoutingKey      string
+}
+
+// Message 待发布的消息, 各字段对应 AMQP 的消息属性
+type Message struct {
+	Body            []byte
+	Headers         map[string]interface{}
+	ContentType     string
+	ContentEncoding string
+	MessageID       string
+	CorrelationID   string
+	Type            string
+	Priority        uint8
+	Timestamp       time.Time
+	// Expiration 消息在队列中的存活时间, 对应 AMQP 的 expiration, 0 表示不过期
+	Expiration time.Duration
+}
+
+// Message 返回与本消息内容和属性相同的待发布消息, 用于重试和死信
+func (d Delivery) Message() Message {
+	return Message{
+		Body:            d.Body,
+		Headers:         d.Headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		MessageID:       d.MessageID,
+		CorrelationID:   d.CorrelationID,
+		Type:            d.Type,
+		Priority:        d.Priority,
+		Timestamp:       d.Timestamp,
+	}
+}
+
+// DeliveryHandler 消息处理函数
+// ctx 在队列 Stop() 或 channel 断开时被取消, 处理函数应尽快放弃正在进行的工作;
+// 返回 nil 时消息被 ack, 否则按失败处理
+type DeliveryHandler func(ctx context.Context, d Delivery) error
+
+// AdaptHandler 把旧的 func([]byte) error 处理函数转换为 DeliveryHandler
+func AdaptHandler(handler func([]byte) error) DeliveryHandler {
+	if handler == nil {
+		return nil
+	}
+	return func(_ context.Context, d Delivery) error {
+		return handler(d.Body)
+	}
+}
+
+func newDelivery(d amqp.Delivery) Delivery {
+	return Delivery{
+		Body:            d.Body,
+		Headers:         d.Headers,
+		MessageID:       d.MessageId,
+		CorrelationID:   d.CorrelationId,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		Type:            d.Type,
+		ReplyTo:         d.ReplyTo,
+		Priority:        d.Priority,
+		Timestamp:       d.Timestamp,
+		Redelivered:     d.Redelivered,
+		Exchange:        d.Exchange,
+		RoutingKey:      d.RoutingKey,
+	}
+}
@@ -0,0 +1,113 @@
+package taskmanager
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/onedotnet/asynctasks/config"
+	"github.com/streadway/amqp"
+)
+
+// BrokerURLs 返回所有可以连接的 broker 地址, 连接和重连时依次轮换
+// 配置了 RABBITMQ_URL 时使用其中逗号分隔的地址; 否则对 RABBITMQ_HOSTS(未配置时为 RABBITMQ_HOST)
+// 中的每个 host[:port] 用经过转义的用户名密码和 vhost 拼出地址, RABBITMQ_TLS 为 true 时使用 amqps
+func BrokerURLs(cfg *config.Config) []string {
+	var urls []string
+	if cfg.RMQURL != "" {
+		for _, addr := range strings.Split(cfg.RMQURL, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				urls = append(urls, addr)
+			}
+		}
+		return urls
+	}
+
+	hosts := []string{cfg.RMQHost}
+	if cfg.RMQHosts != "" {
+		hosts = strings.Split(cfg.RMQHosts, ",")
+	}
+	for _, host := range hosts {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		port := strconv.Itoa(cfg.RMQPort)
+		if h, p, err := net.SplitHostPort(host); err == nil {
+			host, port = h, p
+		}
+		urls = append(urls, brokerURL(cfg, net.JoinHostPort(host, port)))
+	}
+	return urls
+}
+
+func brokerURL(cfg *config.Config, hostport string) string {
+	scheme := "amqp"
+	if cfg.RMQTLS {
+		scheme = "amqps"
+	}
+	u := url.URL{
+		Scheme: scheme,
+		Host:   hostport,
+		Path:   "/" + strings.TrimPrefix(cfg.RMQVHost, "/"),
+	}
+	if cfg.RMQUser != "" {
+		u.User = url.UserPassword(cfg.RMQUser, cfg.RMQPass)
+	}
+	return u.String()
+}
+
+// BrokerTLSConfig 根据配置的 CA 和客户端证书生成 TLS 配置, 都没有配置时返回 nil
+// amqps 地址在返回 nil 时使用系统根证书
+func BrokerTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	if cfg.RMQCACert == "" && cfg.RMQClientCert == "" && cfg.RMQTLSServerName == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{ServerName: cfg.RMQTLSServerName}
+	if cfg.RMQCACert != "" {
+		pem, err := os.ReadFile(cfg.RMQCACert)
+		if err != nil {
+			return nil, fmt.Errorf("messaging queue - read CA cert: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("messaging queue - no certificate found in %s", cfg.RMQCACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.RMQClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.RMQClientCert, cfg.RMQClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("messaging queue - load client cert: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// DialBroker 使用配置中的 TLS 设置连接地址 addr, 支持 amqp 和 amqps(可选客户端证书)
+func DialBroker(cfg *config.Config, addr string) (*amqp.Connection, error) {
+	tlsConfig, err := BrokerTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil && !strings.HasPrefix(addr, "amqps://") {
+		return nil, fmt.Errorf("messaging queue - TLS certificates configured but broker URL is not amqps")
+	}
+	return amqp.DialTLS(addr, tlsConfig)
+}
+
+// RedactURL 返回隐藏了密码的 broker 地址, 用于日志和状态
+func RedactURL(addr string) string {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "<invalid broker url>"
+	}
+	return u.Redacted()
+}
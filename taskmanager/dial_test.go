@@ -0,0 +1,194 @@
+package taskmanager
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/onedotnet/asynctasks/config"
+)
+
+func TestBrokerURLs(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.Config
+		want []string
+	}{
+		{"url list", config.Config{RMQURL: " amqps://a:5671/x , ,amqp://b/ ", RMQHost: "ignored"},
+			[]string{"amqps://a:5671/x", "amqp://b/"}},
+		{"single host", config.Config{RMQHost: "mq", RMQPort: 5672, RMQUser: "guest", RMQPass: "p@ss/word", RMQVHost: "/"},
+			[]string{"amqp://guest:p%40ss%2Fword@mq:5672/"}},
+		{"hosts with ports and tls", config.Config{RMQHosts: "mq1, mq2:5000,", RMQPort: 5671, RMQTLS: true, RMQVHost: "tasks"},
+			[]string{"amqps://mq1:5671/tasks", "amqps://mq2:5000/tasks"}},
+	}
+	for _, tt := range tests {
+		if got := BrokerURLs(&tt.cfg); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: BrokerURLs = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	if got := RedactURL("amqps://guest:secret@mq:5671/"); strings.Contains(got, "secret") {
+		t.Errorf("RedactURL = %q, leaks the password", got)
+	}
+	if got := RedactURL("amqp://%zz"); got != "<invalid broker url>" {
+		t.Errorf("RedactURL of an invalid url = %q", got)
+	}
+}
+
+// testCert 签发一张证书, parent 为空时自签名作为 CA, 返回证书和 PEM 文件路径
+func testCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, usage x509.ExtKeyUsage) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		parent, parentKey = tmpl, key
+	} else {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+		tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, certFile, keyFile
+}
+
+// testBroker 本地的 TLS broker, 要求 CA 签发的客户端证书, 读到 AMQP 协议头后断开
+type testBroker struct {
+	addr    string
+	ca      *x509.Certificate
+	caKey   *ecdsa.PrivateKey
+	caFile  string
+	headers chan string
+}
+
+func tlsBroker(t *testing.T, dir string) *testBroker {
+	t.Helper()
+	ca, caKey, caFile, _ := testCert(t, dir, "ca", nil, nil, 0)
+	_, _, serverCert, serverKey := testCert(t, dir, "server", ca, caKey, x509.ExtKeyUsageServerAuth)
+	cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	headers := make(chan string, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				header := make([]byte, 8)
+				if _, err := io.ReadFull(conn, header); err == nil {
+					headers <- string(header)
+				}
+			}()
+		}
+	}()
+	return &testBroker{addr: "amqps://" + ln.Addr().String() + "/", ca: ca, caKey: caKey, caFile: caFile, headers: headers}
+}
+
+func TestDialBrokerTLS(t *testing.T) {
+	dir := t.TempDir()
+	b := tlsBroker(t, dir)
+	_, _, clientCert, clientKey := testCert(t, dir, "client", b.ca, b.caKey, x509.ExtKeyUsageClientAuth)
+
+	cfg := &config.Config{RMQCACert: b.caFile, RMQClientCert: clientCert, RMQClientKey: clientKey}
+	// 测试 broker 读到协议头后就断开, 只验证 TLS 握手和客户端证书
+	if _, err := DialBroker(cfg, b.addr); err == nil {
+		t.Fatal("DialBroker succeeded against a broker that closes the connection")
+	}
+	select {
+	case header := <-b.headers:
+		if header != "AMQP\x00\x00\x09\x01" {
+			t.Errorf("broker received %q, want the AMQP 0-9-1 protocol header", header)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("broker did not receive the protocol header over TLS")
+	}
+}
+
+func TestDialBrokerTLSRejected(t *testing.T) {
+	dir := t.TempDir()
+	b := tlsBroker(t, dir)
+	addr, caFile := b.addr, b.caFile
+
+	tests := []struct {
+		name string
+		cfg  *config.Config
+		addr string
+		want string
+	}{
+		{"untrusted broker", &config.Config{RMQTLSServerName: "127.0.0.1"}, addr, "certificate"},
+		{"missing client certificate", &config.Config{RMQCACert: caFile}, addr, ""},
+		{"certificates without amqps", &config.Config{RMQCACert: caFile}, strings.Replace(addr, "amqps", "amqp", 1), "not amqps"},
+		{"missing CA file", &config.Config{RMQCACert: filepath.Join(dir, "missing.pem")}, addr, "read CA cert"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DialBroker(tt.cfg, tt.addr)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("DialBroker error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+	select {
+	case header := <-b.headers:
+		t.Errorf("broker received %q from a rejected client", header)
+	default:
+	}
+}
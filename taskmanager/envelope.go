@@ -0,0 +1,195 @@
+package taskmanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// EnvelopeSchemaVersion 当前发布的任务信封版本, Task 结构有不兼容的变化时加一
+	EnvelopeSchemaVersion = 1
+
+	ContentTypeJSON = "application/json"
+
+	HeaderSchemaVersion = "x-schema-version"
+	HeaderAttempt       = "x-attempt"
+	// HeaderDeadline 任务的截止时间 (unix 秒), 节点收到已过期的消息时应直接丢弃
+	HeaderDeadline = "x-deadline"
+)
+
+// traceHeaders 随信封透传的链路追踪 headers
+var traceHeaders = []string{"traceparent", "tracestate", "x-request-id"}
+
+// ErrNoEnvelopeHandler 没有为信封的类型和版本注册处理函数
+var ErrNoEnvelopeHandler = errors.New("envelope - no handler registered")
+
+// Envelope 带版本的任务信封
+// 信封字段映射到 AMQP 消息属性: MessageID -> message_id, Type -> type,
+// Priority -> priority, Deadline -> x-deadline header 和 expiration, SchemaVersion/Attempt/Trace -> headers; Body 仍然是 JSON 编码的 Task,
+// 因此只解析消息体的旧节点不受影响; 节点用 EnvelopeMux 按 Type 和 SchemaVersion 分发, 或用 OpenEnvelope 自己取出信封
+// Attempt 是第几次执行, 失败后由 broker 重新投递时加一, manager 重新调度时为 Retried+1
+type Envelope struct {
+	SchemaVersion int
+	Type          string
+	MessageID     string
+	Attempt       int
+	Priority      uint8
+	Deadline      int64
+	Trace         map[string]string
+	Timestamp     time.Time
+	Body          []byte
+}
+
+// NewTaskEnvelope 把任务装入当前版本的信封
+func NewTaskEnvelope(t *Task) (*Envelope, error) {
+	body, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{
+		SchemaVersion: EnvelopeSchemaVersion,
+		Type:          t.TaskType,
+		MessageID:     t.MessageID.String(),
+		Attempt:       t.Retried + 1,
+		Priority:      t.Priority,
+		Deadline:      t.Deadline,
+		Trace:         map[string]string{},
+		Timestamp:     time.Now(),
+		Body:          body,
+	}, nil
+}
+
+// Message 返回信封对应的待发布消息
+func (e *Envelope) Message() Message {
+	headers := map[string]interface{}{
+		HeaderSchemaVersion: int32(e.SchemaVersion),
+		HeaderAttempt:       int32(e.Attempt),
+	}
+	for k, v := range e.Trace {
+		headers[k] = v
+	}
+	m := Message{
+		Body:        e.Body,
+		Headers:     headers,
+		ContentType: ContentTypeJSON,
+		MessageID:   e.MessageID,
+		Type:        e.Type,
+		Priority:    e.Priority,
+		Timestamp:   e.Timestamp,
+	}
+	if e.Deadline > 0 {
+		headers[HeaderDeadline] = e.Deadline
+		m.Expiration = expirationUntil(e.Deadline)
+	}
+	return m
+}
+
+// OpenEnvelope 从收到的消息中取出信封
+// 没有版本 header 的旧消息视为版本 0, 类型和消息 ID 从消息体中的 Task 读取
+func OpenEnvelope(d Delivery) (*Envelope, error) {
+	e := &Envelope{
+		SchemaVersion: headerInt(d.Headers, HeaderSchemaVersion),
+		Type:          d.Type,
+		MessageID:     d.MessageID,
+		Attempt:       headerInt(d.Headers, HeaderAttempt),
+		Priority:      d.Priority,
+		Deadline:      headerDeadline(d.Headers),
+		Trace:         map[string]string{},
+		Timestamp:     d.Timestamp,
+		Body:          d.Body,
+	}
+	for _, k := range traceHeaders {
+		if v, ok := d.Headers[k].(string); ok {
+			e.Trace[k] = v
+		}
+	}
+
+	if e.SchemaVersion == 0 {
+		var legacy struct {
+			MessageID string `json:"message_id"`
+			TaskType  string `json:"task_type"`
+		}
+		if err := json.Unmarshal(d.Body, &legacy); err != nil {
+			return nil, fmt.Errorf("envelope - legacy message is not a task: %w", err)
+		}
+		e.Type = legacy.TaskType
+		e.MessageID = legacy.MessageID
+	}
+	return e, nil
+}
+
+// Task 解码信封中的任务
+func (e *Envelope) Task() (*Task, error) {
+	var t Task
+	if err := json.Unmarshal(e.Body, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Expired 任务的截止时间已过
+func (e *Envelope) Expired() bool {
+	return e.Deadline > 0 && time.Now().Unix() >= e.Deadline
+}
+
+// WithTrace 设置需要透传的链路追踪 header, 空值会被忽略
+func (e *Envelope) WithTrace(key, value string) *Envelope {
+	if value != "" {
+		e.Trace[key] = value
+	}
+	return e
+}
+
+// TraceHeaders 返回需要透传的链路追踪 header 名称
+func TraceHeaders() []string {
+	return traceHeaders
+}
+
+// PublishEnvelope 通过 DefaultBroker 把信封发布到 route, 并等待 broker 确认
+func PublishEnvelope(ctx context.Context, route string, env *Envelope) error {
+	return DefaultBroker.PublishMessage(ctx, route, env.Message())
+}
+
+// EnvelopeHandler 信封处理函数
+type EnvelopeHandler func(ctx context.Context, env *Envelope) error
+
+type envelopeKey struct {
+	taskType string
+	version  int
+}
+
+// EnvelopeMux 按任务类型和信封版本分发消息, 本身是一个 DeliveryHandler
+// 节点升级时可以同时注册新旧版本的处理函数, 滚动发布期间两种消息都能处理;
+// 过期的消息已经由 consumeHandler 丢弃, 这里不再检查截止时间
+type EnvelopeMux struct {
+	handlers map[envelopeKey]EnvelopeHandler
+}
+
+// NewEnvelopeMux 返回一个空的 EnvelopeMux
+func NewEnvelopeMux() *EnvelopeMux {
+	return &EnvelopeMux{handlers: map[envelopeKey]EnvelopeHandler{}}
+}
+
+// Handle 注册 taskType 在 version 版本下的处理函数, 没有版本 header 的旧消息是版本 0
+// 需要在 Consume 之前注册完成
+func (m *EnvelopeMux) Handle(taskType string, version int, handler EnvelopeHandler) {
+	m.handlers[envelopeKey{taskType: taskType, version: version}] = handler
+}
+
+// HandleDelivery 实现 DeliveryHandler
+// 消息体不是任务时返回 ErrUndecodable, 重试也不会成功, 直接隔离;
+// 没有对应的处理函数时返回 ErrNoEnvelopeHandler, 按普通失败重试, 滚动发布期间可以由其他已升级的节点处理
+func (m *EnvelopeMux) HandleDelivery(ctx context.Context, d Delivery) error {
+	env, err := OpenEnvelope(d)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUndecodable, err)
+	}
+	handler, ok := m.handlers[envelopeKey{taskType: env.Type, version: env.SchemaVersion}]
+	if !ok {
+		return fmt.Errorf("%w: type %q version %d", ErrNoEnvelopeHandler, env.Type, env.SchemaVersion)
+	}
+	return handler(ctx, env)
+}
@@ -0,0 +1,54 @@
+package taskmanager
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestEnvelopeMux(t *testing.T) {
+	mux := NewEnvelopeMux()
+	var got string
+	mux.Handle("video", 0, func(_ context.Context, env *Envelope) error {
+		got = "video/0 " + env.MessageID
+		return nil
+	})
+	mux.Handle("video", EnvelopeSchemaVersion, func(_ context.Context, env *Envelope) error {
+		got = "video/1 " + env.MessageID
+		return nil
+	})
+
+	env, err := NewTaskEnvelope(&Task{TaskType: "video"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := env.Message()
+	current := Delivery{Body: m.Body, Headers: m.Headers, MessageID: m.MessageID, Type: m.Type}
+	legacy := Delivery{Body: []byte(`{"message_id":"legacy-1","task_type":"video"}`)}
+	image := Delivery{Body: []byte(`{"message_id":"legacy-2","task_type":"image"}`)}
+
+	tests := []struct {
+		name    string
+		d       Delivery
+		want    string
+		wantErr error
+	}{
+		{"current version", current, "video/1 " + env.MessageID, nil},
+		{"legacy version", legacy, "video/0 legacy-1", nil},
+		{"unregistered type", image, "", ErrNoEnvelopeHandler},
+		{"not a task", Delivery{Body: []byte("plain text")}, "", ErrUndecodable},
+	}
+	for _, tt := range tests {
+		got = ""
+		err := mux.HandleDelivery(context.Background(), tt.d)
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s: err = %v, want %v", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
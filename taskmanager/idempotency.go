@@ -0,0 +1,172 @@
+package taskmanager
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/onedotnet/asynctasks/config"
+	"github.com/onedotnet/asynctasks/database"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const defaultIdempotencyTTL = 7 * 24 * time.Hour
+
+// idempotencyClaimLease 认领的租约, handler 运行期间每 1/3 租约延长一次;
+// 消费者中途退出时租约过期后才能重新处理
+var idempotencyClaimLease = 5 * time.Minute
+
+// ErrMessageInProgress 同一条消息正在被另一个消费者处理, broker 稍后原样重新投递, 不计入重试次数
+var ErrMessageInProgress = errors.New("idempotency - message is being processed")
+
+// ProcessedMessage 被认领或已经处理成功的消息, 过期后由 PurgeProcessedMessages 清理
+// Scope 区分不同的消费者, 同一条消息被 fanout 到多个队列时各自只处理一次;
+// ProcessedAt 为空表示消息正在处理, ExpiresAt 是认领的租约
+type ProcessedMessage struct {
+	Scope       string     `json:"scope" gorm:"primaryKey;type:varchar(255)"`
+	MessageID   string     `json:"message_id" gorm:"primaryKey;type:varchar(255)"`
+	ProcessedAt *time.Time `json:"processed_at"`
+	ExpiresAt   time.Time  `json:"expires_at" gorm:"index"`
+}
+
+// IdempotencyTTL 已处理消息的保留时间, 由 IDEMPOTENCY_TTL 配置
+func IdempotencyTTL() time.Duration {
+	if config.AppConfig.IdempotencyTTL > 0 {
+		return time.Duration(config.AppConfig.IdempotencyTTL) * time.Second
+	}
+	return defaultIdempotencyTTL
+}
+
+// messageKey 返回消息 ID, 没有时使用信封中的消息 ID
+func messageKey(d Delivery) string {
+	if d.MessageID != "" {
+		return d.MessageID
+	}
+	if env, err := OpenEnvelope(d); err == nil {
+		return env.MessageID
+	}
+	return ""
+}
+
+// Idempotent 包装 handler, 以信封的消息 ID 去重, 见 IdempotentBy
+func Idempotent(scope string, ttl time.Duration, handler DeliveryHandler) DeliveryHandler {
+	return IdempotentBy(scope, ttl, messageKey, handler)
+}
+
+// IdempotentBy 包装 handler, 以 key 返回的值去重:
+// 调用 handler 之前先在 scope 内原子地认领消息, 已经处理成功且未过期的消息直接返回 nil(被 ack),
+// 正在被其他消费者处理的消息返回 ErrMessageInProgress, 两者都不调用 handler;
+// handler 运行期间持续延长认领的租约, 成功后记录消息, 失败时释放认领, 重试和重新投递仍会处理
+// key 返回空字符串的消息总是交给 handler
+func IdempotentBy(scope string, ttl time.Duration, key func(Delivery) string, handler DeliveryHandler) DeliveryHandler {
+	return func(ctx context.Context, d Delivery) error {
+		messageID := key(d)
+		if messageID == "" {
+			return handler(ctx, d)
+		}
+
+		claimed, err := claimMessage(ctx, scope, messageID)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			processed, err := isProcessed(ctx, scope, messageID)
+			if err != nil {
+				return err
+			}
+			if processed {
+				slog.Info("idempotency - message already processed, skipped", "scope", scope, "message_id", messageID)
+				return nil
+			}
+			return ErrMessageInProgress
+		}
+
+		extendCtx, stopExtend := context.WithCancel(ctx)
+		go extendClaim(extendCtx, scope, messageID)
+		err = handler(ctx, d)
+		stopExtend()
+		if err != nil {
+			if releaseErr := releaseMessage(scope, messageID); releaseErr != nil {
+				slog.Error("idempotency - release claimed message failed", "scope", scope, "message_id", messageID, "error", releaseErr)
+			}
+			return err
+		}
+		if err := markProcessed(scope, messageID, ttl); err != nil {
+			// 已经处理成功, 不能因为记录失败而重新处理
+			slog.Error("idempotency - record processed message failed", "scope", scope, "message_id", messageID, "error", err)
+		}
+		return nil
+	}
+}
+
+// claimMessage 插入一条正在处理的记录, 已有记录过期时接管它; 返回是否认领成功
+func claimMessage(ctx context.Context, scope, messageID string) (bool, error) {
+	now := time.Now()
+	res := database.DB().WithContext(ctx).Exec(`INSERT INTO processed_messages (scope, message_id, processed_at, expires_at)
+		VALUES (?, ?, NULL, ?)
+		ON CONFLICT (scope, message_id) DO UPDATE SET processed_at = NULL, expires_at = EXCLUDED.expires_at
+		WHERE processed_messages.expires_at <= ?`, scope, messageID, now.Add(idempotencyClaimLease), now)
+	return res.RowsAffected > 0, res.Error
+}
+
+// extendClaim 每 1/3 租约延长一次认领, 直到 ctx 取消
+func extendClaim(ctx context.Context, scope, messageID string) {
+	ticker := time.NewTicker(idempotencyClaimLease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := database.DB().Model(&ProcessedMessage{}).
+				Where("scope = ? AND message_id = ? AND processed_at IS NULL", scope, messageID).
+				Update("expires_at", time.Now().Add(idempotencyClaimLease)).Error; err != nil {
+				slog.Warn("idempotency - extend claim failed", "scope", scope, "message_id", messageID, "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// releaseMessage 删除还没有处理成功的认领
+func releaseMessage(scope, messageID string) error {
+	return database.DB().Where("scope = ? AND message_id = ? AND processed_at IS NULL", scope, messageID).
+		Delete(&ProcessedMessage{}).Error
+}
+
+func isProcessed(ctx context.Context, scope, messageID string) (bool, error) {
+	var pm ProcessedMessage
+	err := database.DB().WithContext(ctx).
+		Where("scope = ? AND message_id = ? AND processed_at IS NOT NULL AND expires_at > ?", scope, messageID, time.Now()).
+		First(&pm).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func markProcessed(scope, messageID string, ttl time.Duration) error {
+	now := time.Now()
+	return database.DB().Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "scope"}, {Name: "message_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"processed_at", "expires_at"}),
+	}).Create(&ProcessedMessage{
+		Scope:       scope,
+		MessageID:   messageID,
+		ProcessedAt: &now,
+		ExpiresAt:   now.Add(ttl),
+	}).Error
+}
+
+// PurgeProcessedMessages 删除过期的已处理记录, 由后台定时执行
+func PurgeProcessedMessages() {
+	res := database.DB().Where("expires_at <= ?", time.Now()).Delete(&ProcessedMessage{})
+	if res.Error != nil {
+		slog.Error("idempotency - purge processed messages failed", "error", res.Error)
+		return
+	}
+	if res.RowsAffected > 0 {
+		slog.Info("idempotency - purged processed messages", "count", res.RowsAffected)
+	}
+}
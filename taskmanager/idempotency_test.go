@@ -0,0 +1,125 @@
+package taskmanager
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdempotentSkipsDuplicates(t *testing.T) {
+	testDB(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	var calls atomic.Int32
+	handler := Idempotent("test", time.Hour, func(context.Context, Delivery) error {
+		if calls.Add(1) == 1 {
+			close(started)
+			<-release
+		}
+		return nil
+	})
+	d := Delivery{MessageID: "m-1"}
+	ctx := context.Background()
+
+	done := make(chan error, 1)
+	go func() { done <- handler(ctx, d) }()
+	<-started
+
+	// 第一个消费者还在处理
+	if err := handler(ctx, d); !errors.Is(err, ErrMessageInProgress) {
+		t.Fatalf("duplicate while in progress = %v, want ErrMessageInProgress", err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// 已经处理成功, 直接 ack
+	if err := handler(ctx, d); err != nil {
+		t.Fatalf("duplicate after processing = %v, want nil", err)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("handler called %d times, want 1", got)
+	}
+	// 不同的 scope 各自处理一次
+	if err := Idempotent("other", time.Hour, func(context.Context, Delivery) error {
+		calls.Add(1)
+		return nil
+	})(ctx, d); err != nil || calls.Load() != 2 {
+		t.Errorf("other scope = %v with %d calls, want it handled", err, calls.Load())
+	}
+}
+
+func TestIdempotentReleasesOnFailure(t *testing.T) {
+	testDB(t)
+	var calls atomic.Int32
+	handler := Idempotent("test", time.Hour, func(context.Context, Delivery) error {
+		if calls.Add(1) == 1 {
+			return errors.New("boom")
+		}
+		return nil
+	})
+	d := Delivery{MessageID: "m-1"}
+
+	if err := handler(context.Background(), d); err == nil {
+		t.Fatal("want the handler error")
+	}
+	// 重试时重新处理
+	if err := handler(context.Background(), d); err != nil {
+		t.Fatal(err)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("handler called %d times, want 2", got)
+	}
+}
+
+func TestClaimMessageTakesOverExpired(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	if claimed, err := claimMessage(ctx, "test", "m-1"); err != nil || !claimed {
+		t.Fatalf("first claim = %v, %v", claimed, err)
+	}
+	if claimed, err := claimMessage(ctx, "test", "m-1"); err != nil || claimed {
+		t.Fatalf("second claim = %v, %v, want false", claimed, err)
+	}
+
+	// 消费者中途退出, 租约过期后由其他消费者接管
+	testExec(t, db, "UPDATE processed_messages SET expires_at = now() - interval '1 second'")
+	if claimed, err := claimMessage(ctx, "test", "m-1"); err != nil || !claimed {
+		t.Fatalf("claim after the lease expired = %v, %v", claimed, err)
+	}
+}
+
+func TestIdempotentExtendsClaim(t *testing.T) {
+	testDB(t)
+	defer func(d time.Duration) { idempotencyClaimLease = d }(idempotencyClaimLease)
+	idempotencyClaimLease = 300 * time.Millisecond
+
+	started, release := make(chan struct{}), make(chan struct{})
+	var calls atomic.Int32
+	handler := Idempotent("test", time.Hour, func(context.Context, Delivery) error {
+		if calls.Add(1) == 1 {
+			close(started)
+			<-release
+		}
+		return nil
+	})
+	d := Delivery{MessageID: "m-1"}
+	ctx := context.Background()
+
+	done := make(chan error, 1)
+	go func() { done <- handler(ctx, d) }()
+	<-started
+
+	// 处理时间超过了租约, 认领仍然有效
+	time.Sleep(3 * idempotencyClaimLease)
+	err := handler(ctx, d)
+	close(release)
+	if !errors.Is(err, ErrMessageInProgress) {
+		t.Errorf("duplicate after the original lease = %v, want ErrMessageInProgress", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,195 @@
+package taskmanager
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/onedotnet/asynctasks/config"
+	"github.com/streadway/amqp"
+)
+
+// QueueInfo 队列中的消息数和消费者数
+type QueueInfo struct {
+	Name      string `json:"name"`
+	Node      string `json:"node,omitempty"`
+	Messages  int    `json:"messages"`
+	Consumers int    `json:"consumers"`
+	Error     string `json:"error,omitempty"`
+}
+
+// maxRemoveScan RemoveMessages 最多检查的消息数
+const maxRemoveScan = 10000
+
+// QueueInspector 可以查看队列状态的 Broker
+type QueueInspector interface {
+	InspectQueue(name string) (QueueInfo, error)
+}
+
+// MessageRemover 可以从队列中删除指定消息的 Broker
+// RabbitMQ 逐条取出队列中最多 maxRemoveScan 条消息, 确认匹配的消息, 其余的放回原来的位置
+type MessageRemover interface {
+	RemoveMessages(name, messageID string) (int, error)
+}
+
+var (
+	_ QueueInspector = (*QueueProvider)(nil)
+	_ QueueInspector = (*PostgresBroker)(nil)
+	_ QueueInspector = (*AMQPInspector)(nil)
+
+	_ MessageRemover = (*QueueProvider)(nil)
+	_ MessageRemover = (*PostgresBroker)(nil)
+)
+
+// ownQueues 返回 Broker 为自己声明的队列: 本队列, 以及开启时的死信和隔离队列
+func ownQueues(queue, deadLetterQueue, quarantineQueue string, opts QueueOptions) []string {
+	queues := []string{queue}
+	if opts.DeadLetter {
+		queues = append(queues, deadLetterQueue)
+	}
+	if opts.MaxRedelivery > 0 {
+		queues = append(queues, quarantineQueue)
+	}
+	return queues
+}
+
+// Inspect 返回本队列的消息数和消费者数
+func (q *QueueProvider) Inspect() (QueueInfo, error) {
+	return q.InspectQueue(q.queue)
+}
+
+// InspectQueue 通过被动声明读取队列的消息数和消费者数, 队列不存在时返回错误
+func (q *QueueProvider) InspectQueue(name string) (QueueInfo, error) {
+	return inspectAMQPQueue(q.currentConn(), name)
+}
+
+// inspectAMQPQueue 在连接 conn 上被动声明队列, 读取消息数和消费者数
+// 被动声明失败会关闭 channel, 因此每次使用独立的 channel
+func inspectAMQPQueue(conn *amqp.Connection, name string) (QueueInfo, error) {
+	info := QueueInfo{Name: name}
+	if conn == nil || conn.IsClosed() {
+		return info, ErrNotConnected
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		return info, err
+	}
+	defer channel.Close()
+
+	queue, err := channel.QueueDeclarePassive(name, false, false, false, false, nil)
+	if err != nil {
+		return info, err
+	}
+	info.Messages = queue.Messages
+	info.Consumers = queue.Consumers
+	return info, nil
+}
+
+// RemoveMessages 从队列 name 中删除消息 ID 为 messageID 的消息, 返回删除的条数
+func (q *QueueProvider) RemoveMessages(name, messageID string) (int, error) {
+	conn := q.currentConn()
+	if conn == nil || conn.IsClosed() {
+		return 0, ErrNotConnected
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		return 0, err
+	}
+	// 关闭 channel 时没有确认的消息回到队列原来的位置
+	defer channel.Close()
+
+	removed := 0
+	for i := 0; i < maxRemoveScan; i++ {
+		d, ok, err := channel.Get(name, false)
+		if err != nil {
+			return removed, err
+		}
+		if !ok {
+			break
+		}
+		if d.MessageId == messageID {
+			if err := d.Ack(false); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// AMQPInspector 只用于查看队列的 RabbitMQ 连接, 只做被动声明, 不声明 topology 也不消费
+type AMQPInspector struct {
+	conn *amqp.Connection
+}
+
+// DialAMQPInspector 依次尝试配置中的 broker 地址, 返回第一个连接成功的 AMQPInspector
+func DialAMQPInspector(cfg *config.Config) (*AMQPInspector, error) {
+	var errs []error
+	for _, addr := range BrokerURLs(cfg) {
+		conn, err := DialBroker(cfg, addr)
+		if err == nil {
+			return &AMQPInspector{conn: conn}, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", RedactURL(addr), err))
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("messaging queue - no broker address configured")
+	}
+	return nil, errors.Join(errs...)
+}
+
+// InspectQueue 通过被动声明读取队列的消息数和消费者数, 队列不存在时返回错误
+func (a *AMQPInspector) InspectQueue(name string) (QueueInfo, error) {
+	return inspectAMQPQueue(a.conn, name)
+}
+
+// Close 关闭连接
+func (a *AMQPInspector) Close() error {
+	return a.conn.Close()
+}
+
+// InspectQueues 列出 DefaultBroker 的默认队列(及其死信、隔离队列)和每个任务节点的队列
+func InspectQueues() ([]QueueInfo, error) {
+	inspector, ok := DefaultBroker.(QueueInspector)
+	if !ok {
+		return nil, fmt.Errorf("broker %T does not support queue inspection", DefaultBroker)
+	}
+	return InspectQueuesWith(inspector, DefaultQueueNames(DefaultBroker))
+}
+
+// DefaultQueueNames 返回默认队列 b 为自己声明的队列, b 不需要已经启动
+func DefaultQueueNames(b Broker) []string {
+	switch b := b.(type) {
+	case *QueueProvider:
+		return ownQueues(b.Queue(), b.DeadLetterQueue(), b.QuarantineQueue(), b.options)
+	case *PostgresBroker:
+		return ownQueues(b.Queue(), b.DeadLetterQueue(), b.QuarantineQueue(), b.options)
+	}
+	return nil
+}
+
+// InspectQueuesWith 用 inspector 列出队列 queues 和每个任务节点的队列
+// 节点的队列以节点名命名; 无法查看的队列(例如节点还没有声明)在 Error 中说明原因
+func InspectQueuesWith(inspector QueueInspector, queues []string) ([]QueueInfo, error) {
+	var infos []QueueInfo
+	inspect := func(name, node string) {
+		info, err := inspector.InspectQueue(name)
+		info.Node = node
+		if err != nil {
+			info.Error = err.Error()
+		}
+		infos = append(infos, info)
+	}
+
+	for _, name := range queues {
+		inspect(name, "")
+	}
+
+	nodes, err := GetTaskNodeList()
+	if err != nil {
+		return infos, err
+	}
+	for _, node := range nodes {
+		inspect(node.Name, node.Name)
+	}
+	return infos, nil
+}
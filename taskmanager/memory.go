@@ -0,0 +1,463 @@
+package taskmanager
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryBus 进程内的 exchange 和 queue, 同一个 MemoryBus 上的 MemoryBroker 共享它们,
+// 相当于连接到同一个 RabbitMQ
+type MemoryBus struct {
+	mu        sync.Mutex
+	exchanges map[string]*memoryExchange
+	queues    map[string]*memoryQueue
+}
+
+type memoryExchange struct {
+	kind     string
+	bindings []memoryBinding
+}
+
+type memoryBinding struct {
+	queue string
+	key   string
+}
+
+type memoryQueue struct {
+	messages []Delivery
+	// ready 有新消息时通知等待中的消费者
+	ready chan struct{}
+}
+
+// NewMemoryBus 返回一个空的 MemoryBus
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{
+		exchanges: map[string]*memoryExchange{},
+		queues:    map[string]*memoryQueue{},
+	}
+}
+
+func (b *MemoryBus) declareExchange(name, kind string) error {
+	switch kind {
+	case ExchangeDirect, ExchangeFanout, ExchangeTopic:
+	default:
+		return fmt.Errorf("memory broker - unsupported exchange kind %s", kind)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if e, ok := b.exchanges[name]; ok {
+		if e.kind != kind {
+			return fmt.Errorf("memory broker - exchange %s already declared as %s", name, e.kind)
+		}
+		return nil
+	}
+	b.exchanges[name] = &memoryExchange{kind: kind}
+	return nil
+}
+
+func (b *MemoryBus) declareQueue(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.queues[name]; !ok {
+		b.queues[name] = &memoryQueue{ready: make(chan struct{}, 1)}
+	}
+}
+
+func (b *MemoryBus) bind(queue, key, exchange string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.exchanges[exchange]
+	if !ok {
+		return fmt.Errorf("memory broker - no exchange %s", exchange)
+	}
+	for _, binding := range e.bindings {
+		if binding.queue == queue && binding.key == key {
+			return nil
+		}
+	}
+	e.bindings = append(e.bindings, memoryBinding{queue: queue, key: key})
+	return nil
+}
+
+// publish 按 exchange 类型路由消息; 与 RabbitMQ 一致, 空 exchange 直接投递到同名队列,
+// 没有匹配的绑定时消息被丢弃
+// mandatory 为 true 时, 没有路由到任何队列的消息返回 ErrUnroutable
+func (b *MemoryBus) publish(exchange, route string, d Delivery, mandatory bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	d.Exchange = exchange
+	d.RoutingKey = route
+	if d.Timestamp.IsZero() {
+		d.Timestamp = time.Now()
+	}
+
+	if exchange == "" {
+		queue, ok := b.queues[route]
+		if !ok {
+			return b.unroutable(exchange, route, mandatory)
+		}
+		queue.push(d)
+		return nil
+	}
+
+	e, ok := b.exchanges[exchange]
+	if !ok {
+		return fmt.Errorf("memory broker - no exchange %s", exchange)
+	}
+	routed := map[string]bool{}
+	for _, binding := range e.bindings {
+		if routed[binding.queue] || !routeMatches(e.kind, binding.key, route) {
+			continue
+		}
+		if queue, ok := b.queues[binding.queue]; ok {
+			queue.push(d)
+			routed[binding.queue] = true
+		}
+	}
+	if len(routed) == 0 {
+		return b.unroutable(exchange, route, mandatory)
+	}
+	return nil
+}
+
+func (b *MemoryBus) unroutable(exchange, route string, mandatory bool) error {
+	if !mandatory {
+		return nil
+	}
+	return fmt.Errorf("%w: exchange %s route %s", ErrUnroutable, exchange, route)
+}
+
+// requeue 把消息原样放回队列, 保留原来的 exchange 和 routing key
+func (b *MemoryBus) requeue(name string, d Delivery) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if queue, ok := b.queues[name]; ok {
+		queue.push(d)
+	}
+}
+
+// pop 取出队列中的第一条消息
+func (b *MemoryBus) pop(name string) (Delivery, bool, chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	queue := b.queues[name]
+	if len(queue.messages) == 0 {
+		return Delivery{}, false, queue.ready
+	}
+	d := queue.messages[0]
+	queue.messages = queue.messages[1:]
+	if len(queue.messages) > 0 {
+		// 还有消息, 唤醒其他消费者
+		queue.notify()
+	}
+	return d, true, queue.ready
+}
+
+// push 按 Priority 从高到低插入, 相同优先级保持先进先出
+func (queue *memoryQueue) push(d Delivery) {
+	i := len(queue.messages)
+	for i > 0 && queue.messages[i-1].Priority < d.Priority {
+		i--
+	}
+	queue.messages = append(queue.messages, Delivery{})
+	copy(queue.messages[i+1:], queue.messages[i:])
+	queue.messages[i] = d
+	queue.notify()
+}
+
+func (queue *memoryQueue) notify() {
+	select {
+	case queue.ready <- struct{}{}:
+	default:
+	}
+}
+
+// deliveryOf 把待发布的消息转换为消费者收到的 Delivery
+func deliveryOf(m Message) Delivery {
+	return Delivery{
+		Body:            m.Body,
+		Headers:         m.Headers,
+		ContentType:     m.ContentType,
+		ContentEncoding: m.ContentEncoding,
+		MessageID:       m.MessageID,
+		CorrelationID:   m.CorrelationID,
+		Type:            m.Type,
+		Priority:        m.Priority,
+		Timestamp:       m.Timestamp,
+	}
+}
+
+// delivery 按 QueueOptions 压缩消息后转换为投递
+func (m *MemoryBroker) delivery(msg Message) Delivery {
+	return deliveryOf(compressMessage(m.options, msg))
+}
+
+// routeMatches 判断 routing key 是否匹配绑定
+func routeMatches(kind, bindingKey, route string) bool {
+	switch kind {
+	case ExchangeFanout:
+		return true
+	case ExchangeTopic:
+		return topicMatches(strings.Split(bindingKey, "."), strings.Split(route, "."))
+	default:
+		return bindingKey == route
+	}
+}
+
+// topicMatches 按 topic exchange 的规则匹配: "*" 匹配一个单词, "#" 匹配零个或多个单词
+func topicMatches(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	if pattern[0] == "#" {
+		for i := 0; i <= len(words); i++ {
+			if topicMatches(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(words) == 0 {
+		return false
+	}
+	if pattern[0] != "*" && pattern[0] != words[0] {
+		return false
+	}
+	return topicMatches(pattern[1:], words[1:])
+}
+
+// MemoryBroker 进程内的 Broker 实现, 不需要 RabbitMQ 即可测试分发和消息处理逻辑
+// 路由、重试和死信的语义与 QueueProvider 相同
+type MemoryBroker struct {
+	bus          *MemoryBus
+	exchange     string
+	exchangeType string
+	routingKey   string
+	queue        string
+	options      QueueOptions
+	handler      DeliveryHandler
+
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewMemoryBroker 返回一个在 bus 上声明 exchange 和 queue 的 MemoryBroker
+// opts 可选, 不传时使用 QueueOptions 的零值
+func NewMemoryBroker(bus *MemoryBus, exchange, exchangeKind, route, queue string, opts ...QueueOptions) *MemoryBroker {
+	var options QueueOptions
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+	return &MemoryBroker{
+		bus:          bus,
+		exchange:     exchange,
+		exchangeType: exchangeKind,
+		routingKey:   route,
+		queue:        queue,
+		options:      options,
+	}
+}
+
+// DeadLetterExchange 死信 exchange 名称
+func (m *MemoryBroker) DeadLetterExchange() string {
+	return m.exchange + ".dlx"
+}
+
+// DeadLetterQueue 死信队列名称
+func (m *MemoryBroker) DeadLetterQueue() string {
+	return m.queue + ".dlq"
+}
+
+// QuarantineQueue 超过 MaxRedelivery 的消息所在的隔离队列
+func (m *MemoryBroker) QuarantineQueue() string {
+	return m.queue + ".quarantine"
+}
+
+// Declare 声明 exchange、queue 及其绑定
+func (m *MemoryBroker) Declare() error {
+	if err := m.bus.declareExchange(m.exchange, m.exchangeType); err != nil {
+		return err
+	}
+	if m.options.DeadLetter {
+		if err := m.bus.declareExchange(m.DeadLetterExchange(), ExchangeTopic); err != nil {
+			return err
+		}
+		m.bus.declareQueue(m.DeadLetterQueue())
+		if err := m.bus.bind(m.DeadLetterQueue(), m.queue, m.DeadLetterExchange()); err != nil {
+			return err
+		}
+	}
+	if m.options.MaxRedelivery > 0 {
+		m.bus.declareQueue(m.QuarantineQueue())
+	}
+	m.bus.declareQueue(m.queue)
+	return m.bus.bind(m.queue, m.routingKey, m.exchange)
+}
+
+// Publish 发布到默认路由
+func (m *MemoryBroker) Publish(msg []byte) error {
+	return m.PublishTo(m.routingKey, msg)
+}
+
+// PublishTo 发布到 exchange 上的某个路由
+func (m *MemoryBroker) PublishTo(route string, msg []byte) error {
+	return m.bus.publish(m.exchange, route, m.delivery(Message{Body: msg}), false)
+}
+
+// PublishWithConfirm 发布到某个路由, 进程内投递成功即视为确认
+func (m *MemoryBroker) PublishWithConfirm(ctx context.Context, route string, msg []byte) error {
+	return m.PublishMessage(ctx, route, Message{Body: msg})
+}
+
+// PublishMessage 带消息属性发布到某个路由, 进程内投递成功即视为确认
+func (m *MemoryBroker) PublishMessage(ctx context.Context, route string, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.bus.publish(m.exchange, route, m.delivery(msg), true)
+}
+
+// PublishToExchange 发布到其他 exchange
+func (m *MemoryBroker) PublishToExchange(exchange, route string, msg []byte) error {
+	return m.bus.publish(exchange, route, m.delivery(Message{Body: msg}), false)
+}
+
+// PublishMessageToExchange 带消息属性发布到其他 exchange, 进程内投递成功即视为确认
+func (m *MemoryBroker) PublishMessageToExchange(ctx context.Context, exchange, route string, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.bus.publish(exchange, route, m.delivery(msg), true)
+}
+
+// Consume 声明队列并使用 handler 开始消费, 并发数由 QueueOptions.Workers 决定
+func (m *MemoryBroker) Consume(handler DeliveryHandler) error {
+	if err := m.Declare(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handler = handler
+	if m.ctx != nil {
+		return nil
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+
+	workers := m.options.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		m.wg.Add(1)
+		go m.work(m.ctx)
+	}
+	return nil
+}
+
+// Close 停止消费, 等待正在处理的消息结束
+func (m *MemoryBroker) Close() error {
+	m.mu.Lock()
+	cancel := m.cancel
+	m.ctx, m.cancel = nil, nil
+	m.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	m.wg.Wait()
+	return nil
+}
+
+// Status 进程内的 broker 总是已连接
+func (m *MemoryBroker) Status() BrokerStatus {
+	return BrokerStatus{State: ConnConnected, Endpoint: "memory"}
+}
+
+func (m *MemoryBroker) work(ctx context.Context) {
+	defer m.wg.Done()
+	for {
+		if ctx.Err() != nil {
+			// Close 之后不再取出消息
+			return
+		}
+		d, ok, ready := m.bus.pop(m.queue)
+		if !ok {
+			select {
+			case <-ready:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		m.handleDelivery(ctx, d)
+	}
+}
+
+func (m *MemoryBroker) handleDelivery(ctx context.Context, d Delivery) {
+	m.mu.Lock()
+	handler := m.handler
+	m.mu.Unlock()
+
+	d, err := decompressDelivery(d)
+	if err == nil && m.options.MaxRedelivery > 0 && d.Redelivered {
+		// 被 Close 中断后放回队列的消息, 计数后重新发布
+		headers, exceeded := countRedeliveries(m.options, d, redeliveredCount(d))
+		msg := d.Message()
+		msg.Headers = headers
+		if exceeded {
+			slog.Warn("memory broker - message quarantined", "queue", m.queue, "delivered", headers[HeaderDeliveryCount], "error", ErrRedelivered)
+			m.bus.publish("", m.QuarantineQueue(), m.delivery(msg), false)
+			return
+		}
+		m.bus.publish("", m.queue, m.delivery(msg), false)
+		return
+	}
+	if err == nil {
+		err = callHandler(ctx, m.options, handler, d)
+	}
+	if err == nil {
+		return
+	}
+
+	if ctx.Err() != nil {
+		// 因 Close 被中断, 放回队列并且不计入重试次数, work 随后退出
+		d.Redelivered = true
+		m.bus.requeue(m.queue, d)
+		return
+	}
+	action, headers := decideFailure(m.options, d, err)
+
+	msg := d.Message()
+	msg.Headers = headers
+	switch action {
+	case failureRetry:
+		m.bus.publish("", m.queue, m.delivery(msg), false)
+	case failureDefer:
+		select {
+		case <-ctx.Done():
+			d.Redelivered = true
+			m.bus.requeue(m.queue, d)
+		case <-time.After(deferDelay):
+			m.bus.publish("", m.queue, m.delivery(msg), false)
+		}
+	case failureDeadLetter:
+		slog.Warn("memory broker - message dead-lettered", "queue", m.queue, "attempt", headers[HeaderAttempt], "error", err)
+		m.bus.publish(m.DeadLetterExchange(), m.queue, m.delivery(msg), false)
+	case failureQuarantine:
+		slog.Warn("memory broker - message quarantined", "queue", m.queue, "delivered", headers[HeaderDeliveryCount], "error", err)
+		m.bus.publish("", m.QuarantineQueue(), m.delivery(msg), false)
+	case failureDrop:
+		slog.Error("memory broker - message dropped", "queue", m.queue, "message_id", d.MessageID, "error", err)
+	default:
+		d.Redelivered = true
+		m.bus.requeue(m.queue, d)
+	}
+}
@@ -0,0 +1,338 @@
+package taskmanager
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRouteMatches(t *testing.T) {
+	tests := []struct {
+		kind, binding, route string
+		want                 bool
+	}{
+		{ExchangeFanout, "", "anything", true},
+		{ExchangeFanout, "video", "image", true},
+		{ExchangeDirect, "video", "video", true},
+		{ExchangeDirect, "video", "image", false},
+		{ExchangeDirect, "", "", true},
+		{ExchangeTopic, "task.video", "task.video", true},
+		{ExchangeTopic, "task.*", "task.video", true},
+		{ExchangeTopic, "task.*", "task.video.hd", false},
+		{ExchangeTopic, "task.*", "task", false},
+		{ExchangeTopic, "task.#", "task", true},
+		{ExchangeTopic, "task.#", "task.video.hd", true},
+		{ExchangeTopic, "#", "task.video", true},
+		{ExchangeTopic, "#.hd", "task.video.hd", true},
+		{ExchangeTopic, "*.video.#", "task.video", true},
+		{ExchangeTopic, "*.video.#", "task.image", false},
+	}
+	for _, tt := range tests {
+		if got := routeMatches(tt.kind, tt.binding, tt.route); got != tt.want {
+			t.Errorf("routeMatches(%s, %q, %q) = %v, want %v", tt.kind, tt.binding, tt.route, got, tt.want)
+		}
+	}
+}
+
+// collect 消费 broker 的消息, 把消息体依次发送到返回的 channel
+func collect(t *testing.T, b *MemoryBroker) <-chan string {
+	t.Helper()
+	got := make(chan string, 16)
+	if err := b.Consume(func(_ context.Context, d Delivery) error {
+		got <- string(d.Body)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return got
+}
+
+func receive(t *testing.T, got <-chan string) string {
+	t.Helper()
+	select {
+	case body := <-got:
+		return body
+	case <-time.After(time.Second):
+		t.Fatal("no message received")
+		return ""
+	}
+}
+
+func TestMemoryBrokerRouting(t *testing.T) {
+	bus := NewMemoryBus()
+	video := NewMemoryBroker(bus, "tasks", ExchangeTopic, "task.video.*", "video")
+	all := NewMemoryBroker(bus, "tasks", ExchangeTopic, "task.#", "all")
+	videos, everything := collect(t, video), collect(t, all)
+
+	ctx := context.Background()
+	if err := video.PublishMessage(ctx, "task.video.hd", Message{Body: []byte("hd")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := video.PublishMessage(ctx, "task.image", Message{Body: []byte("image")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if body := receive(t, videos); body != "hd" {
+		t.Errorf("video queue got %q, want hd", body)
+	}
+	if a, b := receive(t, everything), receive(t, everything); a != "hd" || b != "image" {
+		t.Errorf("all queue got %q, %q, want hd, image", a, b)
+	}
+}
+
+func TestMemoryBrokerUnroutable(t *testing.T) {
+	bus := NewMemoryBus()
+	b := NewMemoryBroker(bus, "tasks", ExchangeDirect, "video", "video")
+	if err := b.Declare(); err != nil {
+		t.Fatal(err)
+	}
+
+	err := b.PublishMessage(context.Background(), "image", Message{Body: []byte("x")})
+	if !errors.Is(err, ErrUnroutable) {
+		t.Fatalf("PublishMessage to unbound route = %v, want ErrUnroutable", err)
+	}
+	// 不要求确认的发布和 RabbitMQ 一样直接丢弃
+	if err := b.PublishTo("image", []byte("x")); err != nil {
+		t.Fatalf("PublishTo unbound route = %v, want nil", err)
+	}
+}
+
+func TestMemoryBrokerPriority(t *testing.T) {
+	bus := NewMemoryBus()
+	b := NewMemoryBroker(bus, "tasks", ExchangeDirect, "video", "video")
+	if err := b.Declare(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, m := range []Message{
+		{Body: []byte("low-1"), Priority: 1},
+		{Body: []byte("high"), Priority: 9},
+		{Body: []byte("low-2"), Priority: 1},
+	} {
+		if err := b.PublishMessage(ctx, "video", m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := collect(t, b)
+	for _, want := range []string{"high", "low-1", "low-2"} {
+		if body := receive(t, got); body != want {
+			t.Errorf("got %q, want %q", body, want)
+		}
+	}
+}
+
+func TestMemoryBrokerQuarantine(t *testing.T) {
+	bus := NewMemoryBus()
+	b := NewMemoryBroker(bus, "tasks", ExchangeDirect, "video", "video", QueueOptions{MaxRedelivery: 2})
+
+	var mu sync.Mutex
+	calls := 0
+	if err := b.Consume(func(context.Context, Delivery) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		return errors.New("boom")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if err := b.PublishMessage(context.Background(), "video", Message{Body: []byte("poison")}); err != nil {
+		t.Fatal(err)
+	}
+
+	d := waitQuarantined(t, bus, b)
+	if string(d.Body) != "poison" || headerInt(d.Headers, HeaderDeliveryCount) != 3 {
+		t.Errorf("quarantined %q with delivery count %v", d.Body, d.Headers[HeaderDeliveryCount])
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 3 {
+		t.Errorf("handler called %d times, want 3", calls)
+	}
+}
+
+func TestMemoryBrokerCloseRequeues(t *testing.T) {
+	bus := NewMemoryBus()
+	b := NewMemoryBroker(bus, "tasks", ExchangeDirect, "video", "video")
+
+	started := make(chan struct{})
+	var once sync.Once
+	if err := b.Consume(func(ctx context.Context, _ Delivery) error {
+		once.Do(func() { close(started) })
+		<-ctx.Done()
+		return ctx.Err()
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.PublishMessage(context.Background(), "video", Message{Body: []byte("long")}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	closed := make(chan struct{})
+	go func() {
+		b.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return")
+	}
+
+	d, ok, _ := bus.pop("video")
+	if !ok || string(d.Body) != "long" || !d.Redelivered {
+		t.Fatalf("interrupted message not requeued: ok=%v body=%q redelivered=%v", ok, d.Body, d.Redelivered)
+	}
+	if _, ok, _ := bus.pop("video"); ok {
+		t.Fatal("message requeued more than once")
+	}
+}
+
+// waitQuarantined 等待消息进入隔离队列并返回它
+func waitQuarantined(t *testing.T, bus *MemoryBus, b *MemoryBroker) Delivery {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if d, ok, _ := bus.pop(b.QuarantineQueue()); ok {
+			return d
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("message not quarantined")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMemoryBrokerRecoversPanic(t *testing.T) {
+	bus := NewMemoryBus()
+	b := NewMemoryBroker(bus, "tasks", ExchangeDirect, "video", "video", QueueOptions{MaxRedelivery: 1})
+	if err := b.Consume(func(context.Context, Delivery) error {
+		panic("corrupt payload")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if err := b.PublishMessage(context.Background(), "video", Message{Body: []byte("poison")}); err != nil {
+		t.Fatal(err)
+	}
+
+	d := waitQuarantined(t, bus, b)
+	if got := headerInt(d.Headers, HeaderDeliveryCount); got != 2 {
+		t.Errorf("delivery count = %d, want 2", got)
+	}
+}
+
+func TestMemoryBrokerCountsRedeliveries(t *testing.T) {
+	bus := NewMemoryBus()
+	b := NewMemoryBroker(bus, "tasks", ExchangeDirect, "video", "video", QueueOptions{MaxRedelivery: 2})
+	if err := b.Declare(); err != nil {
+		t.Fatal(err)
+	}
+	// 已经重新投递过两次, broker 再次重新投递
+	bus.requeue("video", Delivery{
+		Body:        []byte("crashing"),
+		Headers:     map[string]interface{}{HeaderDeliveryCount: int32(2)},
+		Redelivered: true,
+	})
+
+	called := make(chan struct{}, 1)
+	if err := b.Consume(func(context.Context, Delivery) error {
+		called <- struct{}{}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	d := waitQuarantined(t, bus, b)
+	if got := headerInt(d.Headers, HeaderDeliveryCount); got != 3 {
+		t.Errorf("delivery count = %d, want 3", got)
+	}
+	select {
+	case <-called:
+		t.Error("handler called for a message over MaxRedelivery")
+	default:
+	}
+}
+
+func TestMemoryBrokerQuarantinesUndecodable(t *testing.T) {
+	bus := NewMemoryBus()
+	b := NewMemoryBroker(bus, "tasks", ExchangeDirect, "video", "video", QueueOptions{MaxRedelivery: 2})
+	called := make(chan struct{}, 1)
+	if err := b.Consume(func(context.Context, Delivery) error {
+		called <- struct{}{}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if err := b.PublishMessage(context.Background(), "video", Message{Body: []byte("not gzip"), ContentEncoding: EncodingGzip}); err != nil {
+		t.Fatal(err)
+	}
+
+	d := waitQuarantined(t, bus, b)
+	if string(d.Body) != "not gzip" || d.ContentEncoding != EncodingGzip {
+		t.Errorf("quarantined %q with encoding %q, want the original body", d.Body, d.ContentEncoding)
+	}
+	if _, ok := d.Headers[HeaderDeliveryCount]; ok {
+		t.Error("undecodable message was counted as a retry")
+	}
+	select {
+	case <-called:
+		t.Error("handler called for an undecodable message")
+	default:
+	}
+}
+
+func TestMemoryBrokerDefersInProgress(t *testing.T) {
+	defer func(d time.Duration) { deferDelay = d }(deferDelay)
+	deferDelay = 10 * time.Millisecond
+
+	bus := NewMemoryBus()
+	b := NewMemoryBroker(bus, "tasks", ExchangeDirect, "video", "video", QueueOptions{DeadLetter: true, MaxRedelivery: 1})
+	type call struct {
+		count, attempt int
+	}
+	calls := make(chan call, 8)
+	var n atomic.Int32
+	if err := b.Consume(func(_ context.Context, d Delivery) error {
+		calls <- call{headerInt(d.Headers, HeaderDeliveryCount), headerInt(d.Headers, HeaderAttempt)}
+		if n.Add(1) < 4 {
+			// 另一个消费者还在处理同一个任务
+			return ErrMessageInProgress
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if err := b.PublishMessage(context.Background(), "video", Message{
+		Body:    []byte(testTaskBody),
+		Headers: map[string]interface{}{HeaderAttempt: int32(1)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 超过 MaxRedelivery 次的重复投递既不隔离也不转入死信
+	for i := 0; i < 4; i++ {
+		select {
+		case c := <-calls:
+			if c.count != 0 || c.attempt != 1 {
+				t.Errorf("delivery %d: count %d attempt %d, want the original headers", i+1, c.count, c.attempt)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("delivery %d not redelivered", i+1)
+		}
+	}
+	for _, queue := range []string{b.QuarantineQueue(), b.DeadLetterQueue()} {
+		if _, ok, _ := bus.pop(queue); ok {
+			t.Errorf("in-progress message moved to %s", queue)
+		}
+	}
+}
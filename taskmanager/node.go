@@ -133,6 +133,17 @@ func GetAvaliableTaskNode(capability string) (*TaskNode, error) {
 	return &tn, err
 }
 
+// MarkTaskNodeUnroutable 发往节点的消息无法路由(节点队列不存在)时把节点置为不可用,
+// 节点下一次 keepalive 时会重新上报状态
+func MarkTaskNodeUnroutable(name string, reason error) error {
+	return database.DB().Model(&TaskNode{}).Where("name = ?", name).Updates(map[string]interface{}{
+		"status":        NODE_UNAVAILIABLE,
+		"avaliable":     false,
+		"error_message": reason.Error(),
+		"updated_at":    time.Now(),
+	}).Error
+}
+
 func GetTaskNodeList() ([]TaskNode, error) {
 	var tns []TaskNode
 	err := database.DB().Find(&tns).Error
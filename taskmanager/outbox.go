@@ -0,0 +1,363 @@
+package taskmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/onedotnet/asynctasks/database"
+	"gorm.io/gorm"
+)
+
+const (
+	// outboxBatchSize 每次 relay 最多处理的消息数
+	outboxBatchSize = 100
+	// maxRouteAttempts 消息无法路由时最多尝试的节点数
+	maxRouteAttempts = 3
+	// outboxLease 认领后到记录投递结果之前, 消息对其他 relay 不可见的时间
+	outboxLease = time.Minute
+	// outboxRelayLock 后台 relay 的 advisory lock, 同一时间只有一个 RelayOutbox 在投递
+	outboxRelayLock int64 = 0x6f7574626f78
+	// outboxMinBackoff/outboxMaxBackoff 投递失败后下一次尝试的等待时间范围
+	outboxMinBackoff = 2 * time.Second
+	outboxMaxBackoff = 5 * time.Minute
+)
+
+var (
+	// ErrOutboxBusy outbox 消息正在被其他 relay 投递, 已经投递或放弃, 或者还没有到下一次尝试时间
+	ErrOutboxBusy = errors.New("outbox - message is being relayed or already sent")
+	// ErrOutboxQueued 同一任务类型还有更早的消息没有投递, 留给后台 relay 按顺序投递
+	ErrOutboxQueued = errors.New("outbox - older messages of the task type are waiting")
+)
+
+// OutboxMessage 与任务在同一个事务中写入的待投递消息
+// relay 投递成功并收到 broker 确认后才写入 SentAt, 因此任务不会因为 broker 故障而丢失;
+// 投递失败后按 outboxBackoff 推后 NextAttemptAt, 一直失败的消息不会挡住后面的消息;
+// 任务被暂停时消息保留在 outbox 中, 恢复后按原来的位置投递
+type OutboxMessage struct {
+	ID        int64          `json:"id" gorm:"primary_key"`
+	TaskID    int64          `json:"task_id" gorm:"index"`
+	MessageID uuid.UUID      `json:"message_id" gorm:"type:uuid;index"`
+	TaskType  string         `json:"task_type" gorm:"varchar(255)"`
+	Route     string         `json:"route" gorm:"varchar(255)"`
+	Priority  uint8          `json:"priority" gorm:"default:0"`
+	Body      []byte         `json:"-" gorm:"type:bytea"`
+	Headers   database.JSONB `json:"headers" gorm:"type:jsonb"`
+	Attempts  int            `json:"attempts" gorm:"default:0"`
+	LastError string         `json:"last_error" gorm:"type:text"`
+	SentAt    *time.Time     `json:"sent_at" gorm:"index"`
+	FailedAt  *time.Time     `json:"failed_at"`
+	// NextAttemptAt 下一次可以投递的时间, relay 按它和 ID 的顺序投递
+	NextAttemptAt time.Time `json:"next_attempt_at" gorm:"default:now();index"`
+	// ClaimedUntil relay 认领消息的租约, 不为空并且没有过期时消息正在被投递
+	ClaimedUntil *time.Time `json:"claimed_until"`
+	CreatedAt    time.Time  `json:"created_at" gorm:"default:now()"`
+	UpdatedAt    time.Time  `json:"updated_at" gorm:"default:now()"`
+}
+
+// Message 返回待发布的消息
+func (o *OutboxMessage) Message() Message {
+	m := Message{
+		Body:        o.Body,
+		Headers:     o.Headers,
+		ContentType: ContentTypeJSON,
+		MessageID:   o.MessageID.String(),
+		Type:        o.TaskType,
+		Priority:    o.Priority,
+		Timestamp:   o.CreatedAt,
+	}
+	if deadline := headerDeadline(o.Headers); deadline > 0 {
+		m.Expiration = expirationUntil(deadline)
+	}
+	return m
+}
+
+// enqueueOutbox 在事务 tx 中为任务写入一条 outbox 消息
+// route 为空时由 relay 在投递时选择可用节点
+func enqueueOutbox(tx *gorm.DB, t *Task, route string, trace map[string]string) (*OutboxMessage, error) {
+	env, err := NewTaskEnvelope(t)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range trace {
+		env.WithTrace(k, v)
+	}
+	msg := env.Message()
+
+	o := &OutboxMessage{
+		TaskID:    t.ID,
+		MessageID: t.MessageID,
+		TaskType:  t.TaskType,
+		Route:     route,
+		Priority:  msg.Priority,
+		Body:      msg.Body,
+		Headers:   database.JSONB(msg.Headers),
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	o.NextAttemptAt = o.CreatedAt
+	return o, tx.Create(o).Error
+}
+
+// CreateTaskWithOutbox 在同一个事务中创建任务和它的 outbox 消息
+func CreateTaskWithOutbox(t *Task, route string, trace map[string]string) (*OutboxMessage, error) {
+	t.CreatedAt = time.Now()
+	t.UpdatedAt = time.Now()
+	var o *OutboxMessage
+	err := database.DB().Transaction(func(tx *gorm.DB) error {
+		if err := t.createTx(tx, ActorAPI, ""); err != nil {
+			return err
+		}
+		var err error
+		o, err = enqueueOutbox(tx, t, route, trace)
+		return err
+	})
+	return o, err
+}
+
+// DispatchTask 在同一个事务中保存任务和它的 outbox 消息, 然后立即尝试投递
+// 立即投递失败时消息留在 outbox 中由 relay 重试, 返回的 OutboxMessage.SentAt 为空
+func DispatchTask(ctx context.Context, t *Task, actor, message string) (*OutboxMessage, error) {
+	var o *OutboxMessage
+	err := database.DB().Transaction(func(tx *gorm.DB) error {
+		if err := t.saveTx(tx, actor, message); err != nil {
+			return err
+		}
+		var err error
+		o, err = enqueueOutbox(tx, t, "", nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := o.Relay(ctx); err != nil {
+		slog.Warn("outbox - immediate relay failed, left for relay", "message_id", t.MessageID, "error", err)
+	}
+	return o, nil
+}
+
+// outboxBackoff 第 attempts 次投递失败后到下一次尝试的等待时间
+func outboxBackoff(attempts int) time.Duration {
+	d := outboxMinBackoff
+	for i := 1; i < attempts && d < outboxMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > outboxMaxBackoff {
+		d = outboxMaxBackoff
+	}
+	return d
+}
+
+// claimOutbox 在一个短事务中认领一条到期的 outbox 消息, 把 ClaimedUntil 设为 outboxLease 之后;
+// id 为 0 时认领最早到期的一条 (跳过被暂停的任务类型), 没有可认领的消息时返回 nil
+// 被暂停的任务的消息不会被认领; 投递在事务外进行, 认领期间其他 relay 看不到这条消息,
+// relay 中途退出时租约到期后按原来的顺序重新投递
+func claimOutbox(ctx context.Context, id int64) (*OutboxMessage, error) {
+	var msgs []OutboxMessage
+	err := database.DB().WithContext(ctx).Raw(`UPDATE outbox_messages
+		SET claimed_until = now() + make_interval(secs => ?), updated_at = now()
+		WHERE id = (
+			SELECT id FROM outbox_messages
+			WHERE sent_at IS NULL AND failed_at IS NULL AND next_attempt_at <= now()
+			AND (claimed_until IS NULL OR claimed_until <= now())
+			AND (id = ? OR (? = 0 AND task_type NOT IN (SELECT task_type FROM task_type_pauses)))
+			AND task_id NOT IN (SELECT id FROM tasks WHERE status = ?)
+			ORDER BY next_attempt_at, id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`, outboxLease.Seconds(), id, id, TASK_PAUSED).Scan(&msgs).Error
+	if err != nil || len(msgs) == 0 {
+		return nil, err
+	}
+	return &msgs[0], nil
+}
+
+// Relay 立即投递这条 outbox 消息
+// 同一任务类型还有更早的消息没有投递时返回 ErrOutboxQueued, 由后台 relay 按顺序投递;
+// 正在被后台 relay 处理、已经投递或者还没有到下一次尝试时间时返回 ErrOutboxBusy;
+// 投递结果 (失败次数、无法路由时任务置为失败等) 先提交, 再返回投递错误
+func (o *OutboxMessage) Relay(ctx context.Context) error {
+	if paused, err := isTaskTypePaused(database.DB(), o.TaskType); err != nil {
+		return err
+	} else if paused {
+		// 保留到任务类型恢复
+		return ErrTaskTypePaused
+	}
+
+	var older int64
+	if err := database.DB().WithContext(ctx).Model(&OutboxMessage{}).
+		Where("task_type = ? AND id < ? AND sent_at IS NULL AND failed_at IS NULL", o.TaskType, o.ID).
+		Where("task_id NOT IN (?)", database.DB().Model(&Task{}).Select("id").Where("status = ?", TASK_PAUSED)).
+		Count(&older).Error; err != nil {
+		return err
+	}
+	if older > 0 {
+		return ErrOutboxQueued
+	}
+
+	claimed, err := claimOutbox(ctx, o.ID)
+	if err != nil {
+		return err
+	}
+	if claimed == nil {
+		return ErrOutboxBusy
+	}
+
+	outcome, err := deliverOutbox(ctx, claimed)
+	*o = *claimed
+	if err != nil {
+		return err
+	}
+	return outcome
+}
+
+// RelayOutbox 按 NextAttemptAt 和写入顺序投递 outbox 中所有到期的消息, 由后台定时执行
+// 被暂停的任务类型和任务的消息保留在 outbox 中
+// 持有 outboxRelayLock 时才投递, 定时任务重叠或多个 manager 实例同时运行时只有一个 relay 在工作
+func RelayOutbox() {
+	ctx := context.Background()
+	if _, err := database.WithAdvisoryLock(ctx, outboxRelayLock, func() { relayOutboxBatch(ctx) }); err != nil {
+		slog.Error("outbox - relay lock failed", "error", err)
+	}
+}
+
+func relayOutboxBatch(ctx context.Context) {
+	for i := 0; i < outboxBatchSize; i++ {
+		o, err := claimOutbox(ctx, 0)
+		if err != nil {
+			slog.Error("outbox - relay failed", "error", err)
+			return
+		}
+		if o == nil {
+			return
+		}
+
+		outcome, err := deliverOutbox(ctx, o)
+		if err != nil {
+			slog.Error("outbox - record relay result failed", "message_id", o.MessageID, "error", err)
+			return
+		}
+		if outcome != nil {
+			slog.Warn("outbox - relay message failed", "message_id", o.MessageID, "attempts", o.Attempts, "next_attempt_at", o.NextAttemptAt, "error", outcome)
+		}
+	}
+}
+
+// deliverOutbox 在事务外投递一条已认领的 outbox 消息, 再在短事务中记录结果
+// 任务的截止时间已过时不投递, 任务置为 expired;
+// 消息无法路由时把节点置为不可用并换一个节点, 没有其他可用节点时任务置为失败;
+// 其他投递失败记录错误和次数, 按 outboxBackoff 推后下一次尝试
+// outcome 是投递结果, 已经记录并提交; err 是记录结果时的数据库错误
+func deliverOutbox(ctx context.Context, o *OutboxMessage) (outcome error, err error) {
+	if deadline := headerDeadline(o.Headers); deadline > 0 && time.Now().Unix() >= deadline {
+		// 截止时间已过, 不再投递
+		task := Task{ID: o.TaskID, MessageID: o.MessageID, Deadline: deadline}
+		return ErrTaskExpired, database.DB().Transaction(func(tx *gorm.DB) error {
+			return expireTaskTx(tx, &task, ActorOutbox)
+		})
+	}
+
+	route := o.Route
+	var publishErr, unroutable error
+	for attempt := 0; attempt < maxRouteAttempts; attempt++ {
+		if route == "" {
+			node, nodeErr := GetAvaliableTaskNode(o.TaskType)
+			if nodeErr != nil {
+				publishErr = fmt.Errorf("no avaliable node for %s: %w", o.TaskType, nodeErr)
+				break
+			}
+			route = node.Name
+		}
+		publishErr = DefaultBroker.PublishMessage(ctx, route, o.Message())
+		if !errors.Is(publishErr, ErrUnroutable) {
+			break
+		}
+
+		slog.Warn("outbox - message unroutable, reassigning", "message_id", o.MessageID, "node", route, "error", publishErr)
+		unroutable = publishErr
+		if markErr := MarkTaskNodeUnroutable(route, publishErr); markErr != nil {
+			slog.Error("outbox - mark node unroutable failed", "node", route, "error", markErr)
+		}
+		route = ""
+	}
+
+	now := time.Now()
+	o.Attempts++
+	o.UpdatedAt = now
+	if publishErr != nil && unroutable != nil && (errors.Is(publishErr, ErrUnroutable) || errors.Is(publishErr, gorm.ErrRecordNotFound)) {
+		return unroutable, database.DB().Transaction(func(tx *gorm.DB) error {
+			return failOutboxMessage(tx, o, unroutable)
+		})
+	}
+	if publishErr != nil {
+		// 换过节点时清空路由, 下一次 relay 重新选择节点
+		o.Route = route
+		o.LastError = publishErr.Error()
+		o.NextAttemptAt = now.Add(outboxBackoff(o.Attempts))
+		o.ClaimedUntil = nil
+		return publishErr, database.DB().Model(o).Updates(map[string]interface{}{
+			"route":           o.Route,
+			"attempts":        o.Attempts,
+			"last_error":      o.LastError,
+			"next_attempt_at": o.NextAttemptAt,
+			"claimed_until":   nil,
+			"updated_at":      now,
+		}).Error
+	}
+
+	o.Route = route
+	o.SentAt = &now
+	o.ClaimedUntil = nil
+	return nil, database.DB().Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(o).Where("failed_at IS NULL").Updates(map[string]interface{}{
+			"route":         route,
+			"attempts":      o.Attempts,
+			"sent_at":       now,
+			"claimed_until": nil,
+			"updated_at":    now,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			// 投递期间消息被放弃 (任务被取消或过期), 节点已经收到消息
+			return cancelDeliveredTx(tx, o, route)
+		}
+		return tx.Model(&Task{}).Where("id = ?", o.TaskID).Update("node", route).Error
+	})
+}
+
+// failOutboxMessage 在事务 tx 中放弃投递 outbox 消息并把任务置为失败
+func failOutboxMessage(tx *gorm.DB, o *OutboxMessage, reason error) error {
+	now := time.Now()
+	o.FailedAt = &now
+	o.LastError = reason.Error()
+	if err := tx.Model(o).Updates(map[string]interface{}{
+		"attempts":   o.Attempts,
+		"last_error": o.LastError,
+		"failed_at":  now,
+		"updated_at": now,
+	}).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&Task{}).Where("id = ?", o.TaskID).Update(
+		"errors", gorm.Expr("array_append(errors, ?)", "unroutable: "+reason.Error()),
+	).Error; err != nil {
+		return err
+	}
+	task := Task{ID: o.TaskID, MessageID: o.MessageID}
+	if err := task.transitionTx(tx, TASK_FAILED, ActorOutbox, "unroutable: "+reason.Error()); err != nil {
+		if !errors.Is(err, ErrIllegalTransition) {
+			return err
+		}
+		// 任务已经被取消或过期等, 不再改变状态
+		slog.Warn("outbox - task status not changed", "message_id", o.MessageID, "error", err)
+	}
+	slog.Error("outbox - no routable node, task failed", "message_id", o.MessageID, "error", reason)
+	return nil
+}
@@ -0,0 +1,134 @@
+package taskmanager
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     string
+	}{
+		{1, "2s"},
+		{2, "4s"},
+		{4, "16s"},
+		{20, "5m0s"},
+	}
+	for _, tt := range tests {
+		if got := outboxBackoff(tt.attempts).String(); got != tt.want {
+			t.Errorf("outboxBackoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+// claimIDs 依次认领 outbox 消息直到没有可认领的, 返回认领到的 ID
+func claimIDs(t *testing.T) []int64 {
+	t.Helper()
+	var ids []int64
+	for {
+		o, err := claimOutbox(context.Background(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if o == nil {
+			return ids
+		}
+		ids = append(ids, o.ID)
+	}
+}
+
+func TestClaimOutboxOrderAndLease(t *testing.T) {
+	db := testDB(t)
+	first := testTask(t, db, &Task{TaskType: TASK_TYPE_VIDEO}, "node-a")
+	second := testTask(t, db, &Task{TaskType: TASK_TYPE_VIDEO}, "node-a")
+	later := testTask(t, db, &Task{TaskType: TASK_TYPE_VIDEO}, "node-a")
+	// 第二条更早到期, 最后一条还没有到下一次尝试时间
+	testExec(t, db, "UPDATE outbox_messages SET next_attempt_at = now() - interval '2 minutes' WHERE id = ?", second.ID)
+	testExec(t, db, "UPDATE outbox_messages SET next_attempt_at = now() + interval '1 minute' WHERE id = ?", later.ID)
+
+	ids := claimIDs(t)
+	if len(ids) != 2 || ids[0] != second.ID || ids[1] != first.ID {
+		t.Fatalf("claimed %v, want [%d %d]", ids, second.ID, first.ID)
+	}
+	// 租约期间不能再次认领
+	if ids := claimIDs(t); len(ids) != 0 {
+		t.Fatalf("claimed %v while leased", ids)
+	}
+
+	// relay 中途退出, 租约到期后重新认领
+	testExec(t, db, "UPDATE outbox_messages SET claimed_until = now() - interval '1 second' WHERE id = ?", first.ID)
+	if ids := claimIDs(t); len(ids) != 1 || ids[0] != first.ID {
+		t.Fatalf("claimed %v after the lease expired, want [%d]", ids, first.ID)
+	}
+}
+
+func TestClaimOutboxSkipsLocked(t *testing.T) {
+	db := testDB(t)
+	first := testTask(t, db, &Task{TaskType: TASK_TYPE_VIDEO}, "node-a")
+	second := testTask(t, db, &Task{TaskType: TASK_TYPE_VIDEO}, "node-a")
+
+	// 另一个 relay 正在认领第一条
+	tx := db.Begin()
+	defer tx.Rollback()
+	if err := tx.Exec("SELECT id FROM outbox_messages WHERE id = ? FOR UPDATE", first.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := claimOutbox(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o == nil || o.ID != second.ID {
+		t.Fatalf("claimed %v, want message %d", o, second.ID)
+	}
+	if o, err := claimOutbox(context.Background(), first.ID); err != nil || o != nil {
+		t.Fatalf("claimOutbox(locked) = %v, %v, want nil", o, err)
+	}
+}
+
+func TestRelayKeepsOrder(t *testing.T) {
+	db := testDB(t)
+	bus := useMemoryBroker(t, "node-a")
+	first := testTask(t, db, &Task{TaskType: TASK_TYPE_VIDEO}, "node-a")
+	second := testTask(t, db, &Task{TaskType: TASK_TYPE_VIDEO}, "node-a")
+
+	if err := second.Relay(context.Background()); !errors.Is(err, ErrOutboxQueued) {
+		t.Fatalf("relay behind an older message = %v, want ErrOutboxQueued", err)
+	}
+	if err := first.Relay(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if first.SentAt == nil || first.ClaimedUntil != nil {
+		t.Errorf("relayed message sent_at %v claimed_until %v", first.SentAt, first.ClaimedUntil)
+	}
+	if err := first.Relay(context.Background()); !errors.Is(err, ErrOutboxBusy) {
+		t.Errorf("relay of a sent message = %v, want ErrOutboxBusy", err)
+	}
+
+	d, ok, _ := bus.pop("node-a")
+	if !ok || d.MessageID != first.MessageID.String() {
+		t.Fatalf("node queue got %q, want %s", d.MessageID, first.MessageID)
+	}
+	var task Task
+	if err := db.First(&task, first.TaskID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if task.Node != "node-a" {
+		t.Errorf("task node = %q, want node-a", task.Node)
+	}
+}
+
+func TestRelayClaimedMessageBusy(t *testing.T) {
+	db := testDB(t)
+	useMemoryBroker(t, "node-a")
+	o := testTask(t, db, &Task{TaskType: TASK_TYPE_VIDEO}, "node-a")
+
+	if claimed, err := claimOutbox(context.Background(), 0); err != nil || claimed == nil {
+		t.Fatalf("claimOutbox = %v, %v", claimed, err)
+	}
+	if err := o.Relay(context.Background()); !errors.Is(err, ErrOutboxBusy) {
+		t.Fatalf("relay of a claimed message = %v, want ErrOutboxBusy", err)
+	}
+}
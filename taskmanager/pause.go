@@ -0,0 +1,157 @@
+package taskmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/onedotnet/asynctasks/database"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrTaskPaused 任务已经被暂停
+	ErrTaskPaused = errors.New("task - paused")
+	// ErrTaskTypePaused 任务类型被暂停, outbox 消息留到恢复后再投递
+	ErrTaskTypePaused = errors.New("task type - paused")
+	// ErrTaskQueued 任务的消息已经投递到节点队列, 不能再暂停
+	ErrTaskQueued = errors.New("task - already queued on a node")
+)
+
+// TaskTypePause 被暂停分发的任务类型, 存在期间该类型的 outbox 消息由 manager 保留不投递
+type TaskTypePause struct {
+	TaskType  string    `json:"task_type" gorm:"primary_key;varchar(255)"`
+	Reason    string    `json:"reason" gorm:"type:text"`
+	Actor     string    `json:"actor" gorm:"varchar(255)"`
+	CreatedAt time.Time `json:"created_at" gorm:"default:now()"`
+}
+
+// isTaskTypePaused 任务类型是否被暂停
+func isTaskTypePaused(tx *gorm.DB, taskType string) (bool, error) {
+	var count int64
+	err := tx.Model(&TaskTypePause{}).Where("task_type = ?", taskType).Count(&count).Error
+	return count > 0, err
+}
+
+// PauseTaskType 暂停一个任务类型的分发, 已经暂停时只更新原因
+// 已经投递到节点队列中的消息不受影响
+func PauseTaskType(taskType, actor, reason string) (*TaskTypePause, error) {
+	p := &TaskTypePause{
+		TaskType:  taskType,
+		Reason:    reason,
+		Actor:     actor,
+		CreatedAt: time.Now(),
+	}
+	err := database.DB().Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "task_type"}},
+		DoUpdates: clause.AssignmentColumns([]string{"reason", "actor"}),
+	}).Create(p).Error
+	if err == nil {
+		slog.Warn("pause - task type paused", "task_type", taskType, "actor", actor, "reason", reason)
+	}
+	return p, err
+}
+
+// ResumeTaskType 恢复一个任务类型的分发, 保留的 outbox 消息按写入顺序由 relay 投递
+// RelayOutbox 持有 advisory lock, 与定时的 relay 重叠时只有一个在投递
+func ResumeTaskType(taskType string) error {
+	result := database.DB().Where("task_type = ?", taskType).Delete(&TaskTypePause{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("task type %s is not paused: %w", taskType, gorm.ErrRecordNotFound)
+	}
+	slog.Info("pause - task type resumed", "task_type", taskType)
+	go RelayOutbox()
+	return nil
+}
+
+// GetPausedTaskTypes 列出暂停的任务类型
+func GetPausedTaskTypes() ([]TaskTypePause, error) {
+	var pauses []TaskTypePause
+	err := database.DB().Order("created_at").Find(&pauses).Error
+	return pauses, err
+}
+
+// heldOutboxTx 在事务 tx 中锁住并读取任务还没有投递的 outbox 消息, 没有时返回 nil
+func heldOutboxTx(tx *gorm.DB, taskID int64) (*OutboxMessage, error) {
+	var o OutboxMessage
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("task_id = ? AND sent_at IS NULL AND failed_at IS NULL", taskID).
+		Order("id").First(&o).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// Pause 暂停一个还没有投递到节点的任务, 它的 outbox 消息保留在原来的位置, 暂停期间不会被投递
+// 消息已经投递到节点队列或者正在被 relay 投递时返回 ErrTaskQueued, 节点不需要检查暂停状态
+func (t *Task) Pause(actor, reason string) error {
+	return database.DB().Transaction(func(tx *gorm.DB) error {
+		current, err := lockTask(tx, t.ID, t.MessageID)
+		if err != nil {
+			return err
+		}
+		from := current.Status
+		if from == TASK_PENDING {
+			o, err := heldOutboxTx(tx, current.ID)
+			if err != nil {
+				return err
+			}
+			if o == nil || (o.ClaimedUntil != nil && o.ClaimedUntil.After(time.Now())) {
+				return fmt.Errorf("%w: task %s", ErrTaskQueued, current.MessageID)
+			}
+		}
+		current.Status = TASK_PAUSED
+		if err := current.updateTx(tx, from, actor, reason); err != nil {
+			return err
+		}
+		*t = *current
+		return nil
+	})
+}
+
+// Resume 恢复一个暂停的任务
+// 保留了 outbox 消息的任务置为 pending, 消息按原来的位置投递;
+// 其他任务 (暂停前是 delayed 或 retrying) 置为 delayed, 由 DispatchDelayedTasks 按 RunAt 投递;
+// 返回的 OutboxMessage 为空表示任务交给了调度器
+func (t *Task) Resume(ctx context.Context, actor string) (*OutboxMessage, error) {
+	var o *OutboxMessage
+	err := database.DB().Transaction(func(tx *gorm.DB) error {
+		current, err := lockTask(tx, t.ID, t.MessageID)
+		if err != nil {
+			return err
+		}
+		if current.Status != TASK_PAUSED {
+			return fmt.Errorf("%w: task %s is %s, not %s", ErrIllegalTransition, current.MessageID, current.Status, TASK_PAUSED)
+		}
+		if o, err = heldOutboxTx(tx, current.ID); err != nil {
+			return err
+		}
+		current.Status = TASK_DELAYED
+		if o != nil {
+			current.Status = TASK_PENDING
+		}
+		if err := current.updateTx(tx, TASK_PAUSED, actor, "resume"); err != nil {
+			return err
+		}
+		*t = *current
+		return nil
+	})
+	if err != nil || o == nil {
+		return nil, err
+	}
+
+	if err := o.Relay(ctx); err != nil {
+		slog.Warn("pause - immediate relay failed, left for relay", "message_id", t.MessageID, "error", err)
+	}
+	return o, nil
+}
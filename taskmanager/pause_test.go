@@ -0,0 +1,73 @@
+package taskmanager
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestClaimOutboxSkipsPausedTaskType(t *testing.T) {
+	db := testDB(t)
+	video := testTask(t, db, &Task{TaskType: TASK_TYPE_VIDEO}, "node-a")
+	image := testTask(t, db, &Task{TaskType: TASK_TYPE_ROOP}, "node-a")
+	if _, err := PauseTaskType(TASK_TYPE_VIDEO, "test", "maintenance"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ids := claimIDs(t); len(ids) != 1 || ids[0] != image.ID {
+		t.Fatalf("claimed %v, want only [%d]", ids, image.ID)
+	}
+	if err := video.Relay(context.Background()); !errors.Is(err, ErrTaskTypePaused) {
+		t.Fatalf("relay of a paused task type = %v, want ErrTaskTypePaused", err)
+	}
+
+	// 恢复后按原来的位置投递; ResumeTaskType 会在后台启动 relay, 这里直接删除暂停记录
+	testExec(t, db, "DELETE FROM task_type_pauses WHERE task_type = ?", TASK_TYPE_VIDEO)
+	if ids := claimIDs(t); len(ids) != 1 || ids[0] != video.ID {
+		t.Fatalf("claimed %v after resuming, want [%d]", ids, video.ID)
+	}
+}
+
+func TestPauseHoldsOutbox(t *testing.T) {
+	db := testDB(t)
+	useMemoryBroker(t, "node-a")
+	task := &Task{TaskType: TASK_TYPE_VIDEO}
+	held := testTask(t, db, task, "node-a")
+	next := testTask(t, db, &Task{TaskType: TASK_TYPE_VIDEO}, "node-a")
+
+	if err := task.Pause("test", "wait"); err != nil {
+		t.Fatal(err)
+	}
+	if task.Status != TASK_PAUSED {
+		t.Fatalf("task status = %s, want %s", task.Status, TASK_PAUSED)
+	}
+	if o, err := claimOutbox(context.Background(), held.ID); err != nil || o != nil {
+		t.Fatalf("claimOutbox(paused task) = %v, %v, want nil", o, err)
+	}
+	// 暂停的任务不挡住同类型后面的消息
+	if err := next.Relay(context.Background()); err != nil {
+		t.Fatalf("relay behind a paused task = %v", err)
+	}
+
+	o, err := task.Resume(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Status != TASK_PENDING || o == nil || o.ID != held.ID || o.SentAt == nil {
+		t.Errorf("resumed task %s with outbox %+v, want pending and the held message sent", task.Status, o)
+	}
+}
+
+func TestPauseRelayedTask(t *testing.T) {
+	db := testDB(t)
+	task := &Task{TaskType: TASK_TYPE_VIDEO}
+	testTask(t, db, task, "node-a")
+
+	// relay 已经认领了消息
+	if o, err := claimOutbox(context.Background(), 0); err != nil || o == nil {
+		t.Fatalf("claimOutbox = %v, %v", o, err)
+	}
+	if err := task.Pause("test", "wait"); !errors.Is(err, ErrTaskQueued) {
+		t.Fatalf("pause of a task being relayed = %v, want ErrTaskQueued", err)
+	}
+}
@@ -0,0 +1,532 @@
+package taskmanager
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/onedotnet/asynctasks/config"
+	"github.com/onedotnet/asynctasks/database"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// pgNotifyChannel 发布消息时 NOTIFY 的频道, payload 为队列名
+	pgNotifyChannel = "task_queue"
+	// pgPollInterval 没有收到通知时重新检查队列的间隔, 可见性超时的消息也靠它发现
+	pgPollInterval = time.Second
+
+	defaultVisibilityTimeout = 30 * time.Second
+)
+
+// QueueMessage task_queue 表中的一条消息
+// VisibleAt 之前消息对消费者不可见: 被取走时推迟到可见性超时之后,
+// 处理期间定期延长, 消费者崩溃时消息会在超时后重新出现
+type QueueMessage struct {
+	ID              int64          `json:"id" gorm:"primary_key"`
+	Queue           string         `json:"queue" gorm:"varchar(255);index:idx_task_queue_visible,priority:1"`
+	Exchange        string         `json:"exchange" gorm:"varchar(255)"`
+	RoutingKey      string         `json:"routing_key" gorm:"varchar(255)"`
+	Body            []byte         `json:"-" gorm:"type:bytea"`
+	Headers         database.JSONB `json:"headers" gorm:"type:jsonb"`
+	ContentType     string         `json:"content_type" gorm:"varchar(255)"`
+	ContentEncoding string         `json:"content_encoding" gorm:"varchar(255)"`
+	MessageID       string         `json:"message_id" gorm:"varchar(255)"`
+	CorrelationID   string         `json:"correlation_id" gorm:"varchar(255)"`
+	Type            string         `json:"type" gorm:"varchar(255)"`
+	Priority        uint8          `json:"priority" gorm:"default:0"`
+	Timestamp       time.Time      `json:"timestamp"`
+	Deliveries      int            `json:"deliveries" gorm:"default:0"`
+	VisibleAt       time.Time      `json:"visible_at" gorm:"index:idx_task_queue_visible,priority:2"`
+	CreatedAt       time.Time      `json:"created_at" gorm:"default:now()"`
+}
+
+func (QueueMessage) TableName() string {
+	return "task_queue"
+}
+
+// QueueBinding 队列与 exchange 的绑定
+// 和 RabbitMQ 的默认 exchange 一样, 声明队列即绑定到 exchange "" 上以队列名为 key 的路由
+type QueueBinding struct {
+	ID           int64  `json:"id" gorm:"primary_key"`
+	Exchange     string `json:"exchange" gorm:"varchar(255);uniqueIndex:idx_task_queue_binding"`
+	ExchangeKind string `json:"exchange_kind" gorm:"varchar(255)"`
+	BindingKey   string `json:"binding_key" gorm:"varchar(255);uniqueIndex:idx_task_queue_binding"`
+	Queue        string `json:"queue" gorm:"varchar(255);uniqueIndex:idx_task_queue_binding"`
+}
+
+func (QueueBinding) TableName() string {
+	return "task_queue_bindings"
+}
+
+func (m *QueueMessage) delivery() Delivery {
+	return Delivery{
+		Body:            m.Body,
+		Headers:         m.Headers,
+		MessageID:       m.MessageID,
+		CorrelationID:   m.CorrelationID,
+		ContentType:     m.ContentType,
+		ContentEncoding: m.ContentEncoding,
+		Type:            m.Type,
+		Priority:        m.Priority,
+		Timestamp:       m.Timestamp,
+		Redelivered:     m.Deliveries > 1,
+		Exchange:        m.Exchange,
+		RoutingKey:      m.RoutingKey,
+	}
+}
+
+// PostgresBroker 以 PostgreSQL 表为队列的 Broker 实现, 适合没有 RabbitMQ 的小规模部署和 CI
+// 路由、重试、死信和隔离的语义与 QueueProvider 相同
+type PostgresBroker struct {
+	exchange          string
+	exchangeType      string
+	routingKey        string
+	queue             string
+	options           QueueOptions
+	visibilityTimeout time.Duration
+	handler           DeliveryHandler
+
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	// wake 收到本队列的 NOTIFY 时唤醒等待中的 worker
+	wake chan struct{}
+
+	statusMu sync.Mutex
+	status   BrokerStatus
+}
+
+// NewPostgresBroker 返回一个使用 task_queue 表的 Broker
+// opts 可选, 不传时使用 DefaultQueueOptions()
+func NewPostgresBroker(exchange, exchangeKind, route, queue string, opts ...QueueOptions) *PostgresBroker {
+	options := DefaultQueueOptions()
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+	p := &PostgresBroker{
+		exchange:          exchange,
+		exchangeType:      exchangeKind,
+		routingKey:        route,
+		queue:             queue,
+		options:           options,
+		visibilityTimeout: defaultVisibilityTimeout,
+	}
+	if config.AppConfig.PGQueueVisibilityTimeout > 0 {
+		p.visibilityTimeout = time.Duration(config.AppConfig.PGQueueVisibilityTimeout) * time.Second
+	}
+	p.status = BrokerStatus{
+		State:    ConnConnecting,
+		Since:    time.Now(),
+		Endpoint: fmt.Sprintf("postgres://%s:%d/%s", config.AppConfig.DBHost, config.AppConfig.DBPort, config.AppConfig.DBName),
+	}
+	return p
+}
+
+func (p *PostgresBroker) Queue() string {
+	return p.queue
+}
+
+// DeadLetterExchange 死信 exchange 名称
+func (p *PostgresBroker) DeadLetterExchange() string {
+	return p.exchange + ".dlx"
+}
+
+// DeadLetterQueue 死信队列名称
+func (p *PostgresBroker) DeadLetterQueue() string {
+	return p.queue + ".dlq"
+}
+
+// QuarantineQueue 超过 MaxRedelivery 的消息所在的隔离队列
+func (p *PostgresBroker) QuarantineQueue() string {
+	return p.queue + ".quarantine"
+}
+
+// Declare 声明 exchange、queue 及其绑定
+func (p *PostgresBroker) Declare() error {
+	err := database.DB().Transaction(func(tx *gorm.DB) error {
+		if p.options.DeadLetter {
+			if err := pgBind(tx, "", ExchangeDirect, p.DeadLetterQueue(), p.DeadLetterQueue()); err != nil {
+				return err
+			}
+			if err := pgBind(tx, p.DeadLetterExchange(), ExchangeTopic, p.queue, p.DeadLetterQueue()); err != nil {
+				return err
+			}
+		}
+		if p.options.MaxRedelivery > 0 {
+			if err := pgBind(tx, "", ExchangeDirect, p.QuarantineQueue(), p.QuarantineQueue()); err != nil {
+				return err
+			}
+		}
+		if err := pgBind(tx, "", ExchangeDirect, p.queue, p.queue); err != nil {
+			return err
+		}
+		return pgBind(tx, p.exchange, p.exchangeType, p.routingKey, p.queue)
+	})
+	if err != nil {
+		p.setState(ConnReconnecting, err)
+		return err
+	}
+	p.setState(ConnConnected, nil)
+	return nil
+}
+
+func pgBind(tx *gorm.DB, exchange, kind, key, queue string) error {
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&QueueBinding{
+		Exchange:     exchange,
+		ExchangeKind: kind,
+		BindingKey:   key,
+		Queue:        queue,
+	}).Error
+}
+
+// pgPublish 在事务 tx 中把消息写入所有匹配的队列, 并在提交时通知消费者
+// mandatory 为 true 时, 没有路由到任何队列的消息返回 ErrUnroutable
+func pgPublish(tx *gorm.DB, exchange, route string, m Message, mandatory bool) error {
+	var bindings []QueueBinding
+	if err := tx.Where("exchange = ?", exchange).Find(&bindings).Error; err != nil {
+		return err
+	}
+
+	now := time.Now()
+	timestamp := m.Timestamp
+	if timestamp.IsZero() {
+		timestamp = now
+	}
+	routed := map[string]bool{}
+	for _, b := range bindings {
+		if routed[b.Queue] || !routeMatches(b.ExchangeKind, b.BindingKey, route) {
+			continue
+		}
+		routed[b.Queue] = true
+		if err := tx.Create(&QueueMessage{
+			Queue:           b.Queue,
+			Exchange:        exchange,
+			RoutingKey:      route,
+			Body:            m.Body,
+			Headers:         m.Headers,
+			ContentType:     m.ContentType,
+			ContentEncoding: m.ContentEncoding,
+			MessageID:       m.MessageID,
+			CorrelationID:   m.CorrelationID,
+			Type:            m.Type,
+			Priority:        m.Priority,
+			Timestamp:       timestamp,
+			VisibleAt:       now,
+			CreatedAt:       now,
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("SELECT pg_notify(?, ?)", pgNotifyChannel, b.Queue).Error; err != nil {
+			return err
+		}
+	}
+
+	if len(routed) == 0 && mandatory {
+		return fmt.Errorf("%w: exchange %s route %s", ErrUnroutable, exchange, route)
+	}
+	return nil
+}
+
+func (p *PostgresBroker) publish(ctx context.Context, exchange, route string, m Message, mandatory bool) error {
+	return database.DB().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return pgPublish(tx, exchange, route, compressMessage(p.options, m), mandatory)
+	})
+}
+
+// Publish 发布到默认路由
+func (p *PostgresBroker) Publish(msg []byte) error {
+	return p.PublishTo(p.routingKey, msg)
+}
+
+// PublishTo 发布到 exchange 上的某个路由
+func (p *PostgresBroker) PublishTo(route string, msg []byte) error {
+	return p.publish(context.Background(), p.exchange, route, Message{Body: msg}, false)
+}
+
+// PublishWithConfirm 发布到某个路由, 事务提交即视为确认
+func (p *PostgresBroker) PublishWithConfirm(ctx context.Context, route string, msg []byte) error {
+	return p.PublishMessage(ctx, route, Message{Body: msg})
+}
+
+// PublishMessage 带消息属性发布到某个路由, 事务提交即视为确认
+func (p *PostgresBroker) PublishMessage(ctx context.Context, route string, m Message) error {
+	return p.publish(ctx, p.exchange, route, m, true)
+}
+
+// PublishToExchange 发布到其他 exchange
+func (p *PostgresBroker) PublishToExchange(exchange, route string, msg []byte) error {
+	return p.publish(context.Background(), exchange, route, Message{Body: msg}, false)
+}
+
+// PublishMessageToExchange 带消息属性发布到其他 exchange, 事务提交即视为确认
+func (p *PostgresBroker) PublishMessageToExchange(ctx context.Context, exchange, route string, m Message) error {
+	return p.publish(ctx, exchange, route, m, true)
+}
+
+// Consume 声明队列并使用 handler 开始消费, 并发数由 QueueOptions.Workers 决定
+// 新消息通过 LISTEN/NOTIFY 唤醒 worker, 监听不可用时退化为每秒轮询
+func (p *PostgresBroker) Consume(handler DeliveryHandler) error {
+	if err := p.Declare(); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.handler = handler
+	if p.ctx != nil {
+		return nil
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+
+	workers := p.options.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	p.wake = make(chan struct{}, workers)
+
+	listener := pq.NewListener(database.DSN(config.AppConfig), time.Second, time.Minute, p.listenerEvent)
+	if err := listener.Listen(pgNotifyChannel); err != nil {
+		slog.Warn("postgres queue - listen failed, polling only", "queue", p.queue, "error", err)
+	}
+	p.wg.Add(1)
+	go p.listen(p.ctx, listener)
+
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.work(p.ctx)
+	}
+	return nil
+}
+
+// Close 停止消费, 等待正在处理的消息结束
+func (p *PostgresBroker) Close() error {
+	p.mu.Lock()
+	cancel := p.cancel
+	p.ctx, p.cancel = nil, nil
+	p.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	p.wg.Wait()
+	p.setState(ConnClosed, nil)
+	return nil
+}
+
+// Status 返回数据库连接状态
+func (p *PostgresBroker) Status() BrokerStatus {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	return p.status
+}
+
+func (p *PostgresBroker) setState(state ConnState, err error) {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	if p.status.State != state {
+		p.status.State = state
+		p.status.Since = time.Now()
+	}
+	if err != nil {
+		p.status.LastError = err.Error()
+	}
+}
+
+func (p *PostgresBroker) listenerEvent(event pq.ListenerEventType, err error) {
+	switch event {
+	case pq.ListenerEventConnected, pq.ListenerEventReconnected:
+		p.setState(ConnConnected, nil)
+	case pq.ListenerEventDisconnected, pq.ListenerEventConnectionAttemptFailed:
+		p.setState(ConnReconnecting, err)
+	}
+}
+
+func (p *PostgresBroker) listen(ctx context.Context, listener *pq.Listener) {
+	defer p.wg.Done()
+	defer listener.Close()
+	for {
+		select {
+		case n := <-listener.Notify:
+			// 重连后收到 nil, 期间的通知可能丢失, 唤醒 worker 检查一次
+			if n == nil || n.Extra == p.queue {
+				p.wakeWorkers()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *PostgresBroker) wakeWorkers() {
+	for i := 0; i < cap(p.wake); i++ {
+		select {
+		case p.wake <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
+
+func (p *PostgresBroker) work(ctx context.Context) {
+	defer p.wg.Done()
+	for {
+		msg, err := p.claim(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("postgres queue - claim message failed", "queue", p.queue, "error", err)
+			p.setState(ConnReconnecting, err)
+		}
+		if msg != nil {
+			p.handleMessage(ctx, msg)
+			continue
+		}
+
+		select {
+		case <-p.wake:
+		case <-time.After(pgPollInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// claim 取走队列中优先级最高、最早的一条可见消息, 并把它隐藏到可见性超时之后
+// 行锁使用 SKIP LOCKED, 多个 worker 和实例不会取到同一条消息
+func (p *PostgresBroker) claim(ctx context.Context) (*QueueMessage, error) {
+	var msgs []QueueMessage
+	err := database.DB().WithContext(ctx).Raw(`UPDATE task_queue
+		SET visible_at = now() + make_interval(secs => ?), deliveries = deliveries + 1
+		WHERE id = (
+			SELECT id FROM task_queue
+			WHERE queue = ? AND visible_at <= now()
+			ORDER BY priority DESC, id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`, p.visibilityTimeout.Seconds(), p.queue).Scan(&msgs).Error
+	if err != nil || len(msgs) == 0 {
+		return nil, err
+	}
+	p.setState(ConnConnected, nil)
+	return &msgs[0], nil
+}
+
+// extendVisibility 处理期间定期延长消息的可见性超时, 直到 ctx 结束
+func (p *PostgresBroker) extendVisibility(ctx context.Context, id int64) {
+	ticker := time.NewTicker(p.visibilityTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := database.DB().Exec("UPDATE task_queue SET visible_at = now() + make_interval(secs => ?) WHERE id = ?",
+				p.visibilityTimeout.Seconds(), id).Error; err != nil {
+				slog.Warn("postgres queue - extend visibility failed", "id", id, "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *PostgresBroker) handleMessage(ctx context.Context, msg *QueueMessage) {
+	p.mu.Lock()
+	handler := p.handler
+	p.mu.Unlock()
+
+	d, err := decompressDelivery(msg.delivery())
+	if err == nil && p.options.MaxRedelivery > 0 && msg.Deliveries > 1 {
+		// 可见性超时后重新投递 (消费者崩溃或断线) 的次数由 Deliveries 记录
+		headers, exceeded := countRedeliveries(p.options, d, msg.Deliveries-1)
+		d.Headers = headers
+		if exceeded {
+			slog.Warn("postgres queue - message quarantined", "queue", p.queue, "delivered", headers[HeaderDeliveryCount], "error", ErrRedelivered)
+			m := d.Message()
+			p.logResolveError(p.resolve(msg.ID, "", p.QuarantineQueue(), m), msg)
+			return
+		}
+	}
+	if err == nil {
+		extendCtx, stopExtend := context.WithCancel(ctx)
+		go p.extendVisibility(extendCtx, msg.ID)
+		err = callHandler(ctx, p.options, handler, d)
+		stopExtend()
+	}
+
+	if err == nil {
+		p.logResolveError(database.DB().Delete(&QueueMessage{}, msg.ID).Error, msg)
+		return
+	}
+
+	action, headers := decideFailure(p.options, d, err)
+	if ctx.Err() != nil {
+		action = failureRequeue
+	}
+
+	m := d.Message()
+	m.Headers = headers
+	switch action {
+	case failureRetry:
+		p.logResolveError(p.resolve(msg.ID, "", p.queue, m), msg)
+	case failureDeadLetter:
+		slog.Warn("postgres queue - message dead-lettered", "queue", p.queue, "attempt", headers[HeaderAttempt], "error", err)
+		p.logResolveError(p.resolve(msg.ID, p.DeadLetterExchange(), p.queue, m), msg)
+	case failureQuarantine:
+		slog.Warn("postgres queue - message quarantined", "queue", p.queue, "delivered", headers[HeaderDeliveryCount], "error", err)
+		p.logResolveError(p.resolve(msg.ID, "", p.QuarantineQueue(), m), msg)
+	case failureDrop:
+		slog.Error("postgres queue - message dropped", "queue", p.queue, "message_id", d.MessageID, "error", err)
+		p.logResolveError(database.DB().Delete(&QueueMessage{}, msg.ID).Error, msg)
+	case failureDefer:
+		// 这次认领不算一次投递
+		p.logResolveError(database.DB().Exec("UPDATE task_queue SET visible_at = now() + make_interval(secs => ?), deliveries = deliveries - 1 WHERE id = ?",
+			deferDelay.Seconds(), msg.ID).Error, msg)
+	default:
+		p.logResolveError(database.DB().Exec("UPDATE task_queue SET visible_at = now() WHERE id = ?", msg.ID).Error, msg)
+	}
+}
+
+// resolve 在同一个事务中删除原消息并把新消息发布到 exchange/route
+func (p *PostgresBroker) resolve(id int64, exchange, route string, m Message) error {
+	return database.DB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&QueueMessage{}, id).Error; err != nil {
+			return err
+		}
+		return pgPublish(tx, exchange, route, compressMessage(p.options, m), false)
+	})
+}
+
+// logResolveError 记录处理结果写入失败, 消息会在可见性超时后重新投递
+func (p *PostgresBroker) logResolveError(err error, msg *QueueMessage) {
+	if err != nil {
+		slog.Error("postgres queue - resolve message failed, it will be redelivered", "queue", p.queue, "id", msg.ID, "error", err)
+	}
+}
+
+// InspectQueue 返回队列中的消息数, 不跟踪消费者数
+func (p *PostgresBroker) InspectQueue(name string) (QueueInfo, error) {
+	info := QueueInfo{Name: name}
+	var declared int64
+	if err := database.DB().Model(&QueueBinding{}).Where("exchange = ? AND queue = ?", "", name).Count(&declared).Error; err != nil {
+		return info, err
+	}
+	if declared == 0 {
+		return info, fmt.Errorf("postgres queue - queue %s not found", name)
+	}
+
+	var messages int64
+	if err := database.DB().Model(&QueueMessage{}).Where("queue = ?", name).Count(&messages).Error; err != nil {
+		return info, err
+	}
+	info.Messages = int(messages)
+	return info, nil
+}
+
+// RemoveMessages 从队列 name 中删除消息 ID 为 messageID 的消息, 返回删除的条数
+func (p *PostgresBroker) RemoveMessages(name, messageID string) (int, error) {
+	res := database.DB().Where("queue = ? AND message_id = ?", name, messageID).Delete(&QueueMessage{})
+	return int(res.RowsAffected), res.Error
+}
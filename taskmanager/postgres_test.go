@@ -0,0 +1,145 @@
+package taskmanager
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testPostgresBroker 声明一个直连 video 路由的 PostgresBroker, handler 由各个测试设置
+func testPostgresBroker(t *testing.T, opts QueueOptions) *PostgresBroker {
+	t.Helper()
+	p := NewPostgresBroker("tasks", ExchangeDirect, "video", "video", opts)
+	if err := p.Declare(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func mustClaim(t *testing.T, p *PostgresBroker) *QueueMessage {
+	t.Helper()
+	msg, err := p.claim(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg == nil {
+		t.Fatal("no message claimed")
+	}
+	return msg
+}
+
+func TestPostgresBrokerClaimOrder(t *testing.T) {
+	testDB(t)
+	p := testPostgresBroker(t, QueueOptions{})
+	ctx := context.Background()
+	for _, m := range []Message{
+		{Body: []byte("low-1"), Priority: 1},
+		{Body: []byte("high"), Priority: 9},
+		{Body: []byte("low-2"), Priority: 1},
+	} {
+		if err := p.PublishMessage(ctx, "video", m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, want := range []string{"high", "low-1", "low-2"} {
+		msg := mustClaim(t, p)
+		if string(msg.Body) != want || msg.Deliveries != 1 {
+			t.Errorf("claimed %q delivered %d times, want %q once", msg.Body, msg.Deliveries, want)
+		}
+	}
+	// 已认领的消息在可见性超时之前不可见
+	if msg, err := p.claim(ctx); err != nil || msg != nil {
+		t.Fatalf("claim while all messages are invisible = %v, %v", msg, err)
+	}
+}
+
+func TestPostgresBrokerClaimSkipsLocked(t *testing.T) {
+	db := testDB(t)
+	p := testPostgresBroker(t, QueueOptions{})
+	ctx := context.Background()
+	for _, body := range []string{"first", "second"} {
+		if err := p.PublishMessage(ctx, "video", Message{Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 另一个 worker 正在认领第一条
+	var first QueueMessage
+	if err := db.Where("queue = ?", "video").Order("id").First(&first).Error; err != nil {
+		t.Fatal(err)
+	}
+	tx := db.Begin()
+	defer tx.Rollback()
+	if err := tx.Exec("SELECT id FROM task_queue WHERE id = ? FOR UPDATE", first.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := mustClaim(t, p); string(msg.Body) != "second" {
+		t.Fatalf("claimed %q, want second", msg.Body)
+	}
+	if msg, err := p.claim(ctx); err != nil || msg != nil {
+		t.Fatalf("claim of the locked message = %v, %v, want nil", msg, err)
+	}
+}
+
+func TestPostgresBrokerQuarantine(t *testing.T) {
+	db := testDB(t)
+	p := testPostgresBroker(t, QueueOptions{MaxRedelivery: 1})
+	p.handler = func(context.Context, Delivery) error { return errors.New("boom") }
+	ctx := context.Background()
+	if err := p.PublishMessage(ctx, "video", Message{Body: []byte("poison")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 第一次失败重新发布到队列, 第二次超过 MaxRedelivery 被隔离
+	p.handleMessage(ctx, mustClaim(t, p))
+	p.handleMessage(ctx, mustClaim(t, p))
+
+	var msgs []QueueMessage
+	if err := db.Order("id").Find(&msgs).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Queue != p.QuarantineQueue() || string(msgs[0].Body) != "poison" {
+		t.Fatalf("queue contents %+v, want only the quarantined message", msgs)
+	}
+	if got := headerInt(msgs[0].Headers, HeaderDeliveryCount); got != 2 {
+		t.Errorf("delivery count = %d, want 2", got)
+	}
+}
+
+func TestPostgresBrokerDefersInProgress(t *testing.T) {
+	db := testDB(t)
+	p := testPostgresBroker(t, QueueOptions{DeadLetter: true, MaxRedelivery: 1})
+	calls := 0
+	p.handler = func(context.Context, Delivery) error {
+		calls++
+		return ErrMessageInProgress
+	}
+	ctx := context.Background()
+	if err := p.PublishMessage(ctx, "video", Message{Body: []byte(testTaskBody)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 超过 MaxRedelivery 次的重复投递既不隔离也不转入死信
+	for i := 0; i < 3; i++ {
+		msg := mustClaim(t, p)
+		p.handleMessage(ctx, msg)
+
+		var after QueueMessage
+		if err := db.First(&after, msg.ID).Error; err != nil {
+			t.Fatalf("delivery %d: message removed: %v", i+1, err)
+		}
+		if after.Queue != "video" || after.Deliveries != 0 {
+			t.Fatalf("delivery %d: message in %s delivered %d times, want video and 0", i+1, after.Queue, after.Deliveries)
+		}
+		if !after.VisibleAt.After(time.Now()) {
+			t.Fatalf("delivery %d: message visible at %v, want it deferred", i+1, after.VisibleAt)
+		}
+		testExec(t, db, "UPDATE task_queue SET visible_at = now() WHERE id = ?", msg.ID)
+	}
+	if calls != 3 {
+		t.Errorf("handler called %d times, want 3", calls)
+	}
+}
@@ -0,0 +1,246 @@
+package taskmanager
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	minReconnectDelay        = 500 * time.Millisecond
+	defaultMaxReconnectDelay = 30 * time.Second
+	// flushAttempts 补发缓存时同一条消息最多尝试的次数, 连接正常却一直失败的消息会被丢弃
+	flushAttempts = 3
+)
+
+var (
+	// ErrNotConnected 当前没有可用的 broker 连接
+	ErrNotConnected = errors.New("messaging queue - not connected")
+	// ErrPublishBufferFull 断线期间发布缓存已满
+	ErrPublishBufferFull = errors.New("messaging queue - publish buffer full")
+)
+
+// ConnState broker 连接状态
+type ConnState string
+
+const (
+	ConnConnecting   ConnState = "connecting"
+	ConnConnected    ConnState = "connected"
+	ConnReconnecting ConnState = "reconnecting"
+	ConnClosed       ConnState = "closed"
+)
+
+// BrokerStatus broker 连接的当前状态
+type BrokerStatus struct {
+	State     ConnState `json:"state"`
+	Since     time.Time `json:"since"`
+	Endpoint  string    `json:"endpoint,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+	Buffered  int       `json:"buffered"`
+}
+
+// bufferedPublish 断线期间缓存的一条消息
+type bufferedPublish struct {
+	exchange string
+	route    string
+	msg      Message
+}
+
+// reconnectDelay 第 attempt 次重连失败后的等待时间
+// 从 minReconnectDelay 开始指数增长, 不超过 max; 在 [d/2, d) 之间随机, 避免多个实例同时重连
+func reconnectDelay(attempt int, max time.Duration) time.Duration {
+	d := max
+	if attempt < 16 {
+		if exp := minReconnectDelay << attempt; exp < max {
+			d = exp
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Status 返回连接状态
+func (q *QueueProvider) Status() BrokerStatus {
+	q.statusMu.Lock()
+	status := q.status
+	q.statusMu.Unlock()
+	status.Buffered = q.Buffered()
+	return status
+}
+
+// State 返回连接状态
+func (q *QueueProvider) State() ConnState {
+	q.statusMu.Lock()
+	defer q.statusMu.Unlock()
+	return q.status.State
+}
+
+func (q *QueueProvider) setState(state ConnState, err error) {
+	q.statusMu.Lock()
+	defer q.statusMu.Unlock()
+	if q.status.State == ConnClosed {
+		return
+	}
+	if q.status.State != state {
+		q.status.State = state
+		q.status.Since = time.Now()
+	}
+	if err != nil {
+		q.status.LastError = err.Error()
+	}
+}
+
+// setEndpoint 记录当前连接的 broker 地址(已隐藏密码)
+func (q *QueueProvider) setEndpoint(endpoint string) {
+	q.statusMu.Lock()
+	defer q.statusMu.Unlock()
+	q.status.Endpoint = endpoint
+}
+
+func (q *QueueProvider) setLastError(err error) {
+	q.statusMu.Lock()
+	defer q.statusMu.Unlock()
+	q.status.LastError = err.Error()
+}
+
+func (q *QueueProvider) currentConn() *amqp.Connection {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.conn
+}
+
+// currentChannel 返回当前的消费 channel, 未连接时返回 nil
+func (q *QueueProvider) currentChannel() *amqp.Channel {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.conn == nil || q.conn.IsClosed() {
+		return nil
+	}
+	return q.channel
+}
+
+// closeCurrent 取消消费并关闭当前连接
+func (q *QueueProvider) closeCurrent() {
+	q.mu.RLock()
+	conn, channel := q.conn, q.channel
+	q.mu.RUnlock()
+
+	if conn == nil || conn.IsClosed() {
+		return
+	}
+	if err := channel.Cancel(q.tag, true); err != nil {
+		slog.Error("messaging queue - channel cancel failed: " + err.Error())
+	}
+	if err := conn.Close(); err != nil {
+		slog.Error("messaging queue - connection close failed: " + err.Error())
+	}
+}
+
+// publishOrBuffer 已连接时直接发布, 否则放入发布缓存等待重连后补发
+// 缓存中还有消息或者正在补发时也放入缓存, 保证消息按发布的顺序投递
+func (q *QueueProvider) publishOrBuffer(exchange, route string, m Message) error {
+	if channel := q.currentChannel(); channel != nil && q.State() == ConnConnected && !q.buffering() {
+		err := channel.Publish(exchange, route, true, false, q.publishing(m))
+		if err == nil {
+			return nil
+		}
+		slog.Warn("messaging queue - publish failed, buffering", "exchange", exchange, "route", route, "error", err)
+	}
+	if err := q.bufferPublish(bufferedPublish{exchange: exchange, route: route, msg: m}); err != nil {
+		return err
+	}
+	if q.connected() {
+		// 连接正常时不会有重连触发补发
+		go q.flushBuffer()
+	}
+	return nil
+}
+
+// connected 当前连接可用
+func (q *QueueProvider) connected() bool {
+	conn := q.currentConn()
+	return conn != nil && !conn.IsClosed() && q.State() == ConnConnected
+}
+
+// buffering 发布缓存中是否有等待补发的消息
+func (q *QueueProvider) buffering() bool {
+	q.bufferMu.Lock()
+	defer q.bufferMu.Unlock()
+	return q.flushing || len(q.buffer) > 0
+}
+
+func (q *QueueProvider) bufferPublish(p bufferedPublish) error {
+	if q.options.PublishBuffer <= 0 {
+		return ErrNotConnected
+	}
+	q.bufferMu.Lock()
+	defer q.bufferMu.Unlock()
+	if len(q.buffer) >= q.options.PublishBuffer {
+		return ErrPublishBufferFull
+	}
+	q.buffer = append(q.buffer, p)
+	return nil
+}
+
+// Buffered 发布缓存中等待补发的消息数
+func (q *QueueProvider) Buffered() int {
+	q.bufferMu.Lock()
+	defer q.bufferMu.Unlock()
+	return len(q.buffer)
+}
+
+// flushBuffer 按顺序补发缓存的消息, 每条都等待确认后才从缓存头部移除
+// 补发期间新的消息继续排在缓存后面, 缓存不会超过 PublishBuffer;
+// 连接断开时剩余的消息留在缓存中, 重连后由 Run 再次补发;
+// 连接正常时同一条消息失败 flushAttempts 次 (不可路由、nack、确认超时) 后丢弃, 与 PublishTo 一样不保证送达, 不阻塞后面的消息
+func (q *QueueProvider) flushBuffer() {
+	q.bufferMu.Lock()
+	if q.flushing || len(q.buffer) == 0 {
+		q.bufferMu.Unlock()
+		return
+	}
+	q.flushing = true
+	q.bufferMu.Unlock()
+
+	sent, failures := 0, 0
+	for {
+		q.bufferMu.Lock()
+		if len(q.buffer) == 0 {
+			q.flushing = false
+			q.bufferMu.Unlock()
+			break
+		}
+		p := q.buffer[0]
+		q.bufferMu.Unlock()
+
+		err := q.publishConfirmed(context.Background(), p.exchange, p.route, p.msg)
+		if err != nil && !q.connected() {
+			q.bufferMu.Lock()
+			q.flushing = false
+			remaining := len(q.buffer)
+			q.bufferMu.Unlock()
+			slog.Error("messaging queue - flush publish buffer failed", "sent", sent, "remaining", remaining, "error", err)
+			return
+		}
+		if err != nil {
+			if failures++; failures < flushAttempts {
+				select {
+				case <-q.quit:
+				case <-time.After(minReconnectDelay):
+				}
+				continue
+			}
+			slog.Error("messaging queue - buffered message dropped", "exchange", p.exchange, "route", p.route, "message_id", p.msg.MessageID, "error", err)
+		} else {
+			sent++
+		}
+		failures = 0
+		q.bufferMu.Lock()
+		q.buffer = q.buffer[1:]
+		q.bufferMu.Unlock()
+	}
+	slog.Info("messaging queue - publish buffer flushed", "queue", q.queue, "sent", sent)
+}
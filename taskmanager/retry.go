@@ -0,0 +1,123 @@
+package taskmanager
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/onedotnet/asynctasks/config"
+	"gorm.io/gorm"
+)
+
+// 重试等待时间的计算方式
+const (
+	RetryFixed       = "fixed"
+	RetryExponential = "exponential"
+	RetryJitter      = "jitter"
+)
+
+// RetryPolicy 某个任务类型失败后重试的等待策略
+type RetryPolicy struct {
+	Strategy string
+	Base     time.Duration
+	Max      time.Duration
+}
+
+// DefaultRetryPolicy 没有单独配置的任务类型使用的策略
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Strategy: config.AppConfig.RetryStrategy,
+		Base:     time.Duration(config.AppConfig.RetryBaseDelay) * time.Second,
+		Max:      time.Duration(config.AppConfig.RetryMaxDelay) * time.Second,
+	}
+}
+
+// RetryPolicyFor 从 RETRY_POLICIES 中读取任务类型的策略, 格式为 "type:strategy:base[:max]"
+func RetryPolicyFor(taskType string) RetryPolicy {
+	policy := DefaultRetryPolicy()
+	for _, entry := range strings.Split(config.AppConfig.RetryPolicies, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		if len(parts) < 3 || parts[0] != taskType {
+			continue
+		}
+		base, err := strconv.Atoi(parts[2])
+		if err != nil {
+			slog.Warn("retry - invalid policy", "policy", entry, "error", err)
+			break
+		}
+		policy.Strategy = parts[1]
+		policy.Base = time.Duration(base) * time.Second
+		if len(parts) > 3 {
+			if max, err := strconv.Atoi(parts[3]); err == nil {
+				policy.Max = time.Duration(max) * time.Second
+			}
+		}
+		break
+	}
+	return policy
+}
+
+// Backoff 第 attempt 次重试前的等待时间, attempt 从 1 开始
+// exponential 从 Base 开始翻倍, 不超过 Max; jitter 在 [0, exponential) 之间随机
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	if p.Strategy == RetryFixed || attempt < 1 {
+		return p.Base
+	}
+
+	d := p.Base
+	for i := 1; i < attempt && (p.Max <= 0 || d < p.Max); i++ {
+		d *= 2
+	}
+	if p.Max > 0 && d > p.Max {
+		d = p.Max
+	}
+	if p.Strategy == RetryJitter && d > 0 {
+		return time.Duration(rand.Int63n(int64(d)))
+	}
+	return d
+}
+
+// retryExhaustedStatus 重试次数用完后任务的状态
+func retryExhaustedStatus() string {
+	if config.AppConfig.RetryExhaustedStatus == TASK_FAILED {
+		return TASK_FAILED
+	}
+	return TASK_DEAD_LETTERED
+}
+
+// failTx 在事务 tx 中把已加锁的任务从状态 from 置为 failed, columns 是随失败一起更新的列
+// 重试次数按数据库中的 Retried/MaxRetry 计算: 没有用完时置为 retrying, 按 RetryPolicy 设置 RunAt 并清空节点,
+// 到期后由 DispatchDelayedTasks 重新分配节点投递; 用完后置为 RETRY_EXHAUSTED_STATUS;
+// 下一次重试会超过 Deadline 时置为 expired
+func (t *Task) failTx(tx *gorm.DB, from, actor, reason string, columns ...string) error {
+	if reason == "" {
+		reason = TASK_FAILED
+	}
+	t.Status = TASK_FAILED
+	if err := t.updateTx(tx, from, actor, reason, columns...); err != nil {
+		return err
+	}
+
+	if t.Retried >= t.MaxRetry {
+		t.Status = retryExhaustedStatus()
+		slog.Warn("retry - exhausted", "message_id", t.MessageID, "retried", t.Retried, "status", t.Status)
+		return t.updateTx(tx, TASK_FAILED, ActorSystem, fmt.Sprintf("max retry %d exhausted", t.MaxRetry))
+	}
+
+	delay := RetryPolicyFor(t.TaskType).Backoff(t.Retried + 1)
+	runAt := time.Now().Add(delay).Unix()
+	if t.Deadline > 0 && runAt >= t.Deadline {
+		// 等到重试时已经过了截止时间
+		return expireTaskTx(tx, t, ActorSystem)
+	}
+	t.Retried++
+	t.RunAt = runAt
+	t.Node = ""
+	t.Status = TASK_RETRYING
+	slog.Info("retry - scheduled", "message_id", t.MessageID, "retry", t.Retried, "delay", delay)
+	return t.updateTx(tx, TASK_FAILED, ActorSystem, fmt.Sprintf("retry %d/%d in %s", t.Retried, t.MaxRetry, delay),
+		"retried", "run_at", "node")
+}
@@ -0,0 +1,41 @@
+package taskmanager
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	tests := []struct {
+		policy  RetryPolicy
+		attempt int
+		want    time.Duration
+	}{
+		{RetryPolicy{Strategy: RetryFixed, Base: 5 * time.Second, Max: time.Minute}, 1, 5 * time.Second},
+		{RetryPolicy{Strategy: RetryFixed, Base: 5 * time.Second, Max: time.Minute}, 10, 5 * time.Second},
+		{RetryPolicy{Strategy: RetryExponential, Base: 5 * time.Second, Max: time.Minute}, 0, 5 * time.Second},
+		{RetryPolicy{Strategy: RetryExponential, Base: 5 * time.Second, Max: time.Minute}, 1, 5 * time.Second},
+		{RetryPolicy{Strategy: RetryExponential, Base: 5 * time.Second, Max: time.Minute}, 2, 10 * time.Second},
+		{RetryPolicy{Strategy: RetryExponential, Base: 5 * time.Second, Max: time.Minute}, 4, 40 * time.Second},
+		{RetryPolicy{Strategy: RetryExponential, Base: 5 * time.Second, Max: time.Minute}, 5, time.Minute},
+		{RetryPolicy{Strategy: RetryExponential, Base: 5 * time.Second, Max: time.Minute}, 100, time.Minute},
+		{RetryPolicy{Strategy: RetryExponential, Base: time.Second}, 4, 8 * time.Second},
+		{RetryPolicy{Strategy: RetryExponential, Base: 0, Max: time.Minute}, 3, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.Backoff(tt.attempt); got != tt.want {
+			t.Errorf("%+v.Backoff(%d) = %s, want %s", tt.policy, tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicyBackoffJitter(t *testing.T) {
+	p := RetryPolicy{Strategy: RetryJitter, Base: 5 * time.Second, Max: time.Minute}
+	for attempt, ceiling := range map[int]time.Duration{1: 5 * time.Second, 3: 20 * time.Second, 10: time.Minute} {
+		for i := 0; i < 100; i++ {
+			if got := p.Backoff(attempt); got < 0 || got >= ceiling {
+				t.Fatalf("Backoff(%d) = %s, want [0, %s)", attempt, got, ceiling)
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package taskmanager
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/onedotnet/asynctasks/database"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// delayedBatchSize 每次调度最多处理的到期任务数
+const delayedBatchSize = 100
+
+// IsDelayed 任务的 RunAt 还没有到
+func (t *Task) IsDelayed() bool {
+	return t.RunAt > time.Now().Unix()
+}
+
+// DispatchDelayedTasks 把到期的 delayed 和 retrying 任务置为 pending, 并在同一个事务中写入 outbox 由 relay 投递
+// 截止时间已过的任务留给 ExpireTasks 处理
+// 行锁使用 SKIP LOCKED, 多个 manager 实例同时运行时不会重复投递
+func DispatchDelayedTasks() {
+	for {
+		dispatched, err := dispatchDelayedBatch(context.Background())
+		if err != nil {
+			slog.Error("dispatch delayed tasks failed", "error", err)
+			return
+		}
+		if dispatched < delayedBatchSize {
+			return
+		}
+	}
+}
+
+func dispatchDelayedBatch(ctx context.Context) (int, error) {
+	dispatched := 0
+	err := database.DB().Transaction(func(tx *gorm.DB) error {
+		var tasks []Task
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status IN ? AND run_at <= ?", []string{TASK_DELAYED, TASK_RETRYING}, time.Now().Unix()).
+			Where("deadline = 0 OR deadline > ?", time.Now().Unix()).
+			Order("run_at, id").Limit(delayedBatchSize).Find(&tasks).Error; err != nil {
+			return err
+		}
+
+		for i := range tasks {
+			task := &tasks[i]
+			if err := task.transitionTx(tx, TASK_PENDING, ActorScheduler, "run_at reached"); err != nil {
+				return err
+			}
+			if _, err := enqueueOutbox(tx, task, "", nil); err != nil {
+				return err
+			}
+			slog.Info("delayed task queued for dispatch", "message_id", task.MessageID)
+			dispatched++
+		}
+		return nil
+	})
+	return dispatched, err
+}
@@ -0,0 +1,277 @@
+package taskmanager
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/onedotnet/asynctasks/database"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 任务事件的发起方
+const (
+	ActorAPI        = "api"
+	ActorNode       = "node"
+	ActorScheduler  = "scheduler"
+	ActorOutbox     = "outbox"
+	ActorDeadLetter = "deadletter"
+	ActorSystem     = "system"
+)
+
+var (
+	// ErrUnknownTaskStatus 状态不是 TASK_* 中的一个
+	ErrUnknownTaskStatus = errors.New("task - unknown status")
+	// ErrIllegalTransition 状态机不允许的转换
+	ErrIllegalTransition = errors.New("task - illegal status transition")
+)
+
+// taskTransitions 每个状态允许转换到的状态, completed/cancelled/expired 是终止状态
+// 节点可能不报告 inprogress 直接报告完成, 因此 pending 可以直接转为 completed
+var taskTransitions = map[string][]string{
+	TASK_PENDING:       {TASK_INPROGRESS, TASK_COMPLETED, TASK_FAILED, TASK_RETRYING, TASK_CANCELLED, TASK_EXPIRED, TASK_PAUSED, TASK_DEAD_LETTERED},
+	TASK_DELAYED:       {TASK_PENDING, TASK_CANCELLED, TASK_EXPIRED, TASK_PAUSED},
+	TASK_INPROGRESS:    {TASK_COMPLETED, TASK_FAILED, TASK_RETRYING, TASK_CANCELLED, TASK_EXPIRED, TASK_DEAD_LETTERED},
+	TASK_RETRYING:      {TASK_PENDING, TASK_DELAYED, TASK_INPROGRESS, TASK_FAILED, TASK_CANCELLED, TASK_EXPIRED, TASK_PAUSED, TASK_DEAD_LETTERED},
+	TASK_FAILED:        {TASK_RETRYING, TASK_DELAYED, TASK_PENDING, TASK_CANCELLED, TASK_EXPIRED, TASK_DEAD_LETTERED},
+	TASK_PAUSED:        {TASK_PENDING, TASK_DELAYED, TASK_CANCELLED, TASK_EXPIRED},
+	TASK_DEAD_LETTERED: {TASK_PENDING, TASK_CANCELLED},
+	TASK_COMPLETED:     {},
+	TASK_CANCELLED:     {},
+	TASK_EXPIRED:       {},
+}
+
+// TaskEvent 任务的一次状态转换
+type TaskEvent struct {
+	ID         int64     `json:"id" gorm:"primary_key"`
+	TaskID     int64     `json:"task_id" gorm:"index"`
+	MessageID  uuid.UUID `json:"message_id" gorm:"type:uuid;index"`
+	FromStatus string    `json:"from_status" gorm:"varchar(255)"`
+	ToStatus   string    `json:"to_status" gorm:"varchar(255)"`
+	Actor      string    `json:"actor" gorm:"varchar(255)"`
+	Node       string    `json:"node" gorm:"varchar(255)"`
+	Message    string    `json:"message" gorm:"type:text"`
+	CreatedAt  time.Time `json:"created_at" gorm:"default:now()"`
+}
+
+// NormalizeTaskStatus 把 "Pending"、"in-progress"、"dead-lettered" 等写法统一为 TASK_* 常量
+func NormalizeTaskStatus(status string) string {
+	s := strings.ToLower(strings.TrimSpace(status))
+	switch s {
+	case "in-progress", "in_progress":
+		return TASK_INPROGRESS
+	case "dead-lettered", "deadlettered":
+		return TASK_DEAD_LETTERED
+	}
+	return s
+}
+
+// CanTransition 状态机是否允许从 from 转换到 to, 相同状态总是允许
+func CanTransition(from, to string) error {
+	if _, ok := taskTransitions[to]; !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownTaskStatus, to)
+	}
+	if from == to {
+		return nil
+	}
+	next, ok := taskTransitions[from]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownTaskStatus, from)
+	}
+	for _, s := range next {
+		if s == to {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s -> %s", ErrIllegalTransition, from, to)
+}
+
+// recordTaskEvent 在事务 tx 中记录一次状态转换
+func recordTaskEvent(tx *gorm.DB, t *Task, from, actor, message string) error {
+	return tx.Create(&TaskEvent{
+		TaskID:     t.ID,
+		MessageID:  t.MessageID,
+		FromStatus: from,
+		ToStatus:   t.Status,
+		Actor:      actor,
+		Node:       t.Node,
+		Message:    message,
+		CreatedAt:  time.Now(),
+	}).Error
+}
+
+// createTx 在事务 tx 中创建任务并记录初始状态
+func (t *Task) createTx(tx *gorm.DB, actor, message string) error {
+	t.Status = NormalizeTaskStatus(t.Status)
+	if t.Status == "" {
+		t.Status = TASK_PENDING
+	}
+	if _, ok := taskTransitions[t.Status]; !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownTaskStatus, t.Status)
+	}
+	if err := tx.Create(t).Error; err != nil {
+		return err
+	}
+	return recordTaskEvent(tx, t, "", actor, message)
+}
+
+// lockStatus 在事务 tx 中锁住任务行并返回数据库中的当前状态
+func (t *Task) lockStatus(tx *gorm.DB) (string, error) {
+	var current Task
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Select("id", "status").Where("id = ?", t.ID).First(&current).Error; err != nil {
+		return "", fmt.Errorf("task %d not exists: %w", t.ID, err)
+	}
+	return current.Status, nil
+}
+
+// lockTask 在事务 tx 中锁住并读取任务, id 为 0 时按 messageID 查找
+func lockTask(tx *gorm.DB, id int64, messageID uuid.UUID) (*Task, error) {
+	var t Task
+	q := tx.Clauses(clause.Locking{Strength: "UPDATE"})
+	if id != 0 {
+		q = q.Where("id = ?", id)
+	} else {
+		q = q.Where("message_id = ?", messageID)
+	}
+	if err := q.First(&t).Error; err != nil {
+		return nil, fmt.Errorf("task %d %s not exists: %w", id, messageID, err)
+	}
+	return &t, nil
+}
+
+// updateTx 在事务 tx 中把已加锁的任务从状态 from 转换到 t.Status, 只更新 status 和 columns 列
+func (t *Task) updateTx(tx *gorm.DB, from, actor, message string, columns ...string) error {
+	if err := CanTransition(from, t.Status); err != nil {
+		return err
+	}
+	t.UpdatedAt = time.Now()
+	columns = append([]string{"status", "updated_at"}, columns...)
+	if err := tx.Model(&Task{ID: t.ID}).Select(columns).Updates(t).Error; err != nil {
+		return err
+	}
+	if from == t.Status {
+		return nil
+	}
+	return recordTaskEvent(tx, t, from, actor, message)
+}
+
+// applyReport 把节点上报的字段合并到从数据库读出的任务上, 返回需要更新的列和最后一条新的错误
+// 只接受状态、节点、错误和 payload, 没有上报的字段保持不变; 重试次数等由 manager 维护
+func (t *Task) applyReport(r *Task) (columns []string, reason string) {
+	if r.Status != "" {
+		t.Status = NormalizeTaskStatus(r.Status)
+	}
+	if r.Node != "" && r.Node != t.Node {
+		t.Node = r.Node
+		columns = append(columns, "node")
+	}
+	if r.Payload != nil {
+		t.Payload = r.Payload
+		columns = append(columns, "payload")
+	}
+	known := map[string]bool{}
+	for _, e := range t.Errors {
+		known[e] = true
+	}
+	for _, e := range r.Errors {
+		if e != "" && !known[e] {
+			t.Errors = append(t.Errors, e)
+			known[e] = true
+			reason = e
+		}
+	}
+	if reason != "" {
+		columns = append(columns, "errors")
+	}
+	return columns, reason
+}
+
+// Report 记录节点上报的任务状态, t 是上报的内容, 成功后被替换为数据库中的任务
+// 上报 failed 时由重试引擎决定重试还是结束, 见 failTx
+func (t *Task) Report(actor string) error {
+	return database.DB().Transaction(func(tx *gorm.DB) error {
+		current, err := lockTask(tx, t.ID, t.MessageID)
+		if err != nil {
+			return err
+		}
+		from := current.Status
+		columns, reason := current.applyReport(t)
+
+		switch {
+		case current.Status == TASK_FAILED && (from == TASK_FAILED || from == TASK_RETRYING):
+			// 重复的失败上报, 重试已经安排过, 不再计数
+			current.Status = from
+			err = current.updateTx(tx, from, actor, reason, columns...)
+		case current.Status == TASK_FAILED:
+			err = current.failTx(tx, from, actor, reason, columns...)
+		default:
+			err = current.updateTx(tx, from, actor, reason, columns...)
+		}
+		if err != nil {
+			return err
+		}
+		*t = *current
+		return nil
+	})
+}
+
+// saveTx 在事务 tx 中保存整个任务, 状态变化必须符合状态机并会被记录
+func (t *Task) saveTx(tx *gorm.DB, actor, message string) error {
+	from, err := t.lockStatus(tx)
+	if err != nil {
+		return err
+	}
+	t.Status = NormalizeTaskStatus(t.Status)
+	if err := CanTransition(from, t.Status); err != nil {
+		return err
+	}
+	t.UpdatedAt = time.Now()
+	if err := tx.Save(t).Error; err != nil {
+		return err
+	}
+	if from == t.Status {
+		return nil
+	}
+	return recordTaskEvent(tx, t, from, actor, message)
+}
+
+// transitionTx 在事务 tx 中只更新任务状态, 转换必须符合状态机并会被记录
+func (t *Task) transitionTx(tx *gorm.DB, to, actor, message string) error {
+	from, err := t.lockStatus(tx)
+	if err != nil {
+		return err
+	}
+	if err := CanTransition(from, to); err != nil {
+		return err
+	}
+	t.Status = to
+	t.UpdatedAt = time.Now()
+	if err := tx.Model(&Task{}).Where("id = ?", t.ID).Updates(map[string]interface{}{
+		"status":     to,
+		"updated_at": t.UpdatedAt,
+	}).Error; err != nil {
+		return err
+	}
+	if from == to {
+		return nil
+	}
+	return recordTaskEvent(tx, t, from, actor, message)
+}
+
+// Transition 把任务转换到状态 to 并记录事件, 非法转换返回 ErrIllegalTransition
+func (t *Task) Transition(to, actor, message string) error {
+	return database.DB().Transaction(func(tx *gorm.DB) error {
+		return t.transitionTx(tx, to, actor, message)
+	})
+}
+
+// GetTaskEvents 按时间顺序列出任务的状态转换
+func GetTaskEvents(taskID int64) ([]TaskEvent, error) {
+	var events []TaskEvent
+	err := database.DB().Where("task_id = ?", taskID).Order("id").Find(&events).Error
+	return events, err
+}
@@ -0,0 +1,55 @@
+package taskmanager
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     error
+	}{
+		{TASK_PENDING, TASK_INPROGRESS, nil},
+		{TASK_PENDING, TASK_PAUSED, nil},
+		{TASK_PENDING, TASK_COMPLETED, nil},
+		{TASK_DELAYED, TASK_PENDING, nil},
+		{TASK_INPROGRESS, TASK_COMPLETED, nil},
+		{TASK_FAILED, TASK_RETRYING, nil},
+		{TASK_FAILED, TASK_CANCELLED, nil},
+		{TASK_RETRYING, TASK_DELAYED, nil},
+		{TASK_PAUSED, TASK_PENDING, nil},
+		{TASK_DEAD_LETTERED, TASK_PENDING, nil},
+		{TASK_DEAD_LETTERED, TASK_CANCELLED, nil},
+		{TASK_DEAD_LETTERED, TASK_COMPLETED, ErrIllegalTransition},
+		{TASK_COMPLETED, TASK_COMPLETED, nil},
+		{TASK_COMPLETED, TASK_PENDING, ErrIllegalTransition},
+		{TASK_CANCELLED, TASK_INPROGRESS, ErrIllegalTransition},
+		{TASK_EXPIRED, TASK_RETRYING, ErrIllegalTransition},
+		{TASK_DELAYED, TASK_COMPLETED, ErrIllegalTransition},
+		{TASK_INPROGRESS, TASK_PAUSED, ErrIllegalTransition},
+		{TASK_PENDING, "done", ErrUnknownTaskStatus},
+		{"done", TASK_PENDING, ErrUnknownTaskStatus},
+	}
+	for _, tt := range tests {
+		if err := CanTransition(tt.from, tt.to); !errors.Is(err, tt.want) {
+			t.Errorf("CanTransition(%s, %s) = %v, want %v", tt.from, tt.to, err, tt.want)
+		}
+	}
+}
+
+func TestNormalizeTaskStatus(t *testing.T) {
+	tests := map[string]string{
+		"Pending":       TASK_PENDING,
+		" in-progress ": TASK_INPROGRESS,
+		"in_progress":   TASK_INPROGRESS,
+		"Dead-Lettered": TASK_DEAD_LETTERED,
+		"deadlettered":  TASK_DEAD_LETTERED,
+		TASK_PAUSED:     TASK_PAUSED,
+	}
+	for in, want := range tests {
+		if got := NormalizeTaskStatus(in); got != want {
+			t.Errorf("NormalizeTaskStatus(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
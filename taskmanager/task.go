@@ -1,7 +1,6 @@
 package taskmanager
 
 import (
-	"fmt"
 	"time"
 
 	"github.com/google/uuid"
@@ -68,6 +67,11 @@ const (
 	TASK_TYPE_VIDEO   = "video"
 )
 
+// MaxTaskPriority 任务的最高优先级, 也是声明队列时的 x-max-priority
+// 任务发布到节点自己声明的队列, 节点声明时必须带上 x-max-priority = MaxTaskPriority (见 NodeQueueArgs),
+// 否则 RabbitMQ 忽略消息的 priority, 任务按先进先出投递; 已经存在的队列需要删除后重新声明才能改变这个参数
+const MaxTaskPriority = 10
+
 type Task struct {
 	ID        int64          `json:"id" gorm:"primary_key"`
 	MessageID uuid.UUID      `json:"message_id" gorm:"type:uuid;unique_index"`
@@ -79,6 +83,9 @@ type Task struct {
 	Retried   int            `json:"retried" gorm:"default:0"`
 	MaxRetry  int            `json:"max_retry" gorm:"default:3"`
 	Deadline  int64          `json:"deadline" gorm:"default:0"`
+	RunAt     int64          `json:"run_at" gorm:"default:0;index"`
+	Node      string         `json:"node" gorm:"varchar(255)"`
+	Priority  uint8          `json:"priority" gorm:"default:0"`
 	CreatedAt time.Time      `json:"created_at" gorm:"default:now()"`
 	UpdatedAt time.Time      `json:"updated_at" gorm:"default:now()"`
 }
@@ -97,10 +104,7 @@ func CreateTask(t *Task) error {
 	t.CreatedAt = time.Now()
 	t.UpdatedAt = time.Now()
 	err := database.DB().Transaction(func(tx *gorm.DB) error {
-		if err := tx.Create(t).Error; err != nil {
-			return err
-		}
-		return nil
+		return t.createTx(tx, ActorAPI, "")
 	})
 	return err
 }
@@ -113,28 +117,21 @@ func CreateRoopTask(tn *TaskRoop) (*Task, error) {
 		TaskType: TASK_TYPE_ROOP,
 	}
 	err := database.DB().Transaction(func(tx *gorm.DB) error {
-		if err := tx.Create(&task).Error; err != nil {
-			return err
-		}
-		return nil
+		return task.createTx(tx, ActorAPI, "")
 	})
 	return &task, err
 }
 
+// Update 保存任务, 状态变化必须符合状态机, 非法转换返回 ErrIllegalTransition
 func (t *Task) Update() error {
-	var count int64
-	database.DB().Model(&Task{}).Where("id = ?", t.ID).Count(&count)
-	if count == 0 {
-		return fmt.Errorf("task %d not exists", t.ID)
-	}
-	t.UpdatedAt = time.Now()
-	err := database.DB().Transaction(func(tx *gorm.DB) error {
-		if err := tx.Save(t).Error; err != nil {
-			return err
-		}
-		return nil
+	return t.UpdateAs(ActorSystem, "")
+}
+
+// UpdateAs 保存任务并以 actor 的身份记录状态转换
+func (t *Task) UpdateAs(actor, message string) error {
+	return database.DB().Transaction(func(tx *gorm.DB) error {
+		return t.saveTx(tx, actor, message)
 	})
-	return err
 }
 
 func GetTaskByUUID(uid uuid.UUID) (*Task, error) {